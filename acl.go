@@ -1,10 +1,8 @@
 package main
 
 import (
-	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -40,132 +38,66 @@ func LoadACLConfig(filepath string) (*ACLConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := config.SetRules(config.Rules); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
-// EvaluateACLs evaluates the ACL rules based on the request and returns the action to be taken.
+// ValidateACLRules checks that the rules compile: known conditions and
+// actions, values of the expected type, the required options, regular
+// expressions and CIDR ranges that parse, and if expressions that only
+// reference defined named conditions.
+func ValidateACLRules(rules []ACLRule) error {
+	_, err := compileACL(rules)
+	return err
+}
+
+// EvaluateACLs returns the action of the first rule matching the request,
+// or an empty string if none matches.
 func EvaluateACLs(req *http.Request, aclConfig *ACLConfig) (string, error) {
-	for _, rule := range aclConfig.Rules {
-		switch rule.Condition {
-		case "path_beg":
-			if strings.HasPrefix(req.URL.Path, rule.Value.(string)) {
-				return rule.Action, nil
-			}
-		case "method":
-			if strings.EqualFold(req.Method, rule.Value.(string)) {
-				return rule.Action, nil
-			}
-		case "path_reg":
-			matched, err := regexp.MatchString(rule.Value.(string), req.URL.Path)
-			if err != nil {
-				return "", err
-			}
-			if matched {
-				return rule.Action, nil
-			}
-		}
+	rule, ok := aclConfig.Match(req)
+	if !ok {
+		return "", nil
 	}
-	return "", nil
+	return rule.Action, nil
 }
 
 // HandleRequestWithACL handles the incoming request based on the ACL configuration.
 func HandleRequestWithACL(r *http.Request, w http.ResponseWriter, aclConfig *ACLConfig) bool {
-	rules := aclConfig.GetRules()
-	for _, rule := range rules {
-		matched := false
-
-		switch rule.Condition {
-		case "path_beg":
-			matched = strings.HasPrefix(r.URL.Path, rule.Value.(string))
-		case "path_end":
-			matched = strings.HasSuffix(r.URL.Path, rule.Value.(string))
-		case "path_sub":
-			matched = strings.Contains(r.URL.Path, rule.Value.(string))
-		case "method":
-			matched = strings.EqualFold(r.Method, rule.Value.(string))
-		case "header":
-			if len(rule.Options) > 0 {
-				headerValue := r.Header.Get(rule.Options[0])
-				matched = strings.EqualFold(strings.TrimSpace(headerValue), strings.TrimSpace(rule.Value.(string)))
-			}
-		case "query_param":
-			queryValues := r.URL.Query()
-			matched = queryValues.Get(rule.Value.(string)) != ""
-		case "query_param_val":
-			if len(rule.Options) > 0 {
-				queryValues := r.URL.Query()
-				matched = queryValues.Get(rule.Value.(string)) == rule.Options[0]
-			}
-		case "ip_src":
-			overrideHeader := ""
-			if len(rule.Options) > 0 {
-				overrideHeader = rule.Options[0]
-			}
-			clientIP := getEffectiveClientIP(r, overrideHeader)
-			matched = clientIP == rule.Value.(string)
-		case "ip_src_range":
-			overrideHeader := ""
-			if len(rule.Options) > 0 {
-				overrideHeader = rule.Options[0]
-			}
-			clientIP := getEffectiveClientIP(r, overrideHeader)
-			matched = ipInRange(clientIP, rule.Value.(string))
-		case "ssl":
-			matched = r.TLS != nil
-		case "cookie":
-			cookie, err := r.Cookie(rule.Value.(string))
-			matched = err == nil && cookie != nil
-		case "cookie_val":
-			if len(rule.Options) > 0 {
-				cookie, err := r.Cookie(rule.Value.(string))
-				matched = err == nil && cookie != nil && cookie.Value == rule.Options[0]
-			}
-		case "method_path_beg":
-			if valueMap, ok := rule.Value.(map[string]interface{}); ok {
-				method, okMethod := valueMap["method"].(string)
-				path, okPath := valueMap["path"].(string)
-				matched = okMethod && okPath && r.Method == method && strings.HasPrefix(r.URL.Path, path)
-			}
-		case "always":
-			matched = true
-		}
-
-		if matched {
-			switch rule.Action {
-			case "deny":
-				http.Error(w, "Access Denied", http.StatusForbidden)
-				return true
-			case "redirect":
-				if len(rule.Options) > 0 {
-					redirectURL := rule.Options[0]
-					http.Redirect(w, r, redirectURL, http.StatusFound)
-					return true
-				}
-			case "allow":
-				logInfo("Allowing request due to rule: %s", rule.Name)
-				return false
-			}
-		}
+	rule, ok := aclConfig.Match(r)
+	if !ok {
+		logInfo("No ACL rules matched for the request")
+		return false
 	}
 
-	logInfo("No ACL rules matched for the request")
+	rotationTriggers.OnACLMatch(rule.Name)
+	switch rule.Action {
+	case "deny":
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return true
+	case "redirect":
+		http.Redirect(w, r, rule.Options[0], http.StatusFound)
+		return true
+	}
+	logInfo("Allowing request due to rule: %s", rule.Name)
 	return false
 }
 
-// ipInRange checks if the given IP address is in the given CIDR range.
-func ipInRange(remoteAddr, ruleValue string) bool {
-	clientIP := strings.Split(remoteAddr, ":")[0]
-	_, ipNet, err := net.ParseCIDR(ruleValue)
-	if err != nil {
-		return clientIP == ruleValue
+// Match returns the first rule matching the request.
+func (config *ACLConfig) Match(r *http.Request) (ACLRule, bool) {
+	config.mu.RLock()
+	compiled := config.compiled
+	config.mu.RUnlock()
+	if compiled == nil {
+		return ACLRule{}, false
 	}
-
-	requestIP := net.ParseIP(clientIP)
-	if requestIP == nil {
-		return false
+	rule, ok := compiled.match(r)
+	if !ok {
+		return ACLRule{}, false
 	}
-	return ipNet.Contains(requestIP)
+	return rule.ACLRule, true
 }
 
 // AddRule adds a rule to the ACL configuration.
@@ -175,28 +107,34 @@ func (config *ACLConfig) AddRule(rule ACLRule) {
 	config.Rules = append(config.Rules, rule)
 }
 
-// RemoveRule removes a rule from the ACL configuration.
-func (config *ACLConfig) RemoveRule(name string) {
+// RemoveRule removes a rule from the ACL configuration and reports whether
+// it existed.
+func (config *ACLConfig) RemoveRule(name string) bool {
 	config.mu.Lock()
 	defer config.mu.Unlock()
 	for i, rule := range config.Rules {
-		if rule.Name == name {
-			config.Rules = append(config.Rules[:i], config.Rules[i+1:]...)
-			break
+		if rule.ID() == name {
+			config.Rules = append(config.Rules[:i:i], config.Rules[i+1:]...)
+			return true
 		}
 	}
+	return false
 }
 
-// UpdateRule updates an existing rule in the ACL configuration.
-func (config *ACLConfig) UpdateRule(updatedRule ACLRule) {
+// UpdateRule replaces the rule with the given name and reports whether it
+// existed.
+func (config *ACLConfig) UpdateRule(name string, updatedRule ACLRule) bool {
 	config.mu.Lock()
 	defer config.mu.Unlock()
 	for i, rule := range config.Rules {
-		if rule.Name == updatedRule.Name {
-			config.Rules[i] = updatedRule
-			break
+		if rule.ID() == name {
+			rules := append([]ACLRule(nil), config.Rules...)
+			rules[i] = updatedRule
+			config.Rules = rules
+			return true
 		}
 	}
+	return false
 }
 
 // GetRules returns the list of rules in the ACL configuration.
@@ -206,13 +144,18 @@ func (config *ACLConfig) GetRules() []ACLRule {
 	return config.Rules
 }
 
-// ReloadACL compile rules and ensure that the allow all rule is the last rule in the ACL configuration.
-func ReloadACL() {
-	aclMutex.Lock()
-	defer aclMutex.Unlock()
-
-	aclConfig.EnsureAllowAllLast()
-	logInfo("ACL configuration reloaded.")
+// SetRules compiles the rules and replaces every rule of the ACL
+// configuration at once. The current rules are kept if they do not compile.
+func (config *ACLConfig) SetRules(rules []ACLRule) error {
+	compiled, err := compileACL(rules)
+	if err != nil {
+		return err
+	}
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	config.Rules = rules
+	config.compiled = compiled
+	return nil
 }
 
 // AddRuleWithPriority add a rule to the ACL configuration at the given priority.
@@ -220,12 +163,15 @@ func (config *ACLConfig) AddRuleWithPriority(rule ACLRule, priority int) {
 	config.mu.Lock()
 	defer config.mu.Unlock()
 
+	rules := make([]ACLRule, 0, len(config.Rules)+1)
 	if priority < 0 || priority >= len(config.Rules) {
-		config.Rules = append(config.Rules, rule)
+		rules = append(append(rules, config.Rules...), rule)
 	} else {
-		config.Rules = append(config.Rules[:priority+1], config.Rules[priority:]...)
-		config.Rules[priority] = rule
+		rules = append(rules, config.Rules[:priority]...)
+		rules = append(rules, rule)
+		rules = append(rules, config.Rules[priority:]...)
 	}
+	config.Rules = rules
 }
 
 // EnsureAllowAllLast ensure that the allow all rule is the last rule in the ACL configuration.
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aclMatcher tests one condition against a request.
+type aclMatcher func(r *http.Request) bool
+
+// aclConditions builds the matcher of each condition from the value and
+// options of the rule, so every value is checked and every regular
+// expression compiled once, when the rules are loaded.
+var aclConditions = map[string]func(value interface{}, options []string) (aclMatcher, error){
+	"always": func(value interface{}, options []string) (aclMatcher, error) {
+		return func(r *http.Request) bool { return true }, nil
+	},
+	"ssl": func(value interface{}, options []string) (aclMatcher, error) {
+		return func(r *http.Request) bool { return r.TLS != nil }, nil
+	},
+	"path_beg": stringCondition(func(r *http.Request, value string) bool {
+		return strings.HasPrefix(r.URL.Path, value)
+	}),
+	"path_end": stringCondition(func(r *http.Request, value string) bool {
+		return strings.HasSuffix(r.URL.Path, value)
+	}),
+	"path_sub": stringCondition(func(r *http.Request, value string) bool {
+		return strings.Contains(r.URL.Path, value)
+	}),
+	"path_reg": regexCondition(func(r *http.Request) string { return r.URL.Path }),
+	"method": stringCondition(func(r *http.Request, value string) bool {
+		return strings.EqualFold(r.Method, value)
+	}),
+	"query_param": stringCondition(func(r *http.Request, value string) bool {
+		return r.URL.Query().Get(value) != ""
+	}),
+	"cookie": stringCondition(func(r *http.Request, value string) bool {
+		_, err := r.Cookie(value)
+		return err == nil
+	}),
+	"header": func(value interface{}, options []string) (aclMatcher, error) {
+		expected, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(options) == 0 {
+			return nil, fmt.Errorf("the header name is required as first option")
+		}
+		expected = strings.TrimSpace(expected)
+		return func(r *http.Request) bool {
+			return strings.EqualFold(strings.TrimSpace(r.Header.Get(options[0])), expected)
+		}, nil
+	},
+	"query_param_val": func(value interface{}, options []string) (aclMatcher, error) {
+		name, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(options) == 0 {
+			return nil, fmt.Errorf("the expected value is required as first option")
+		}
+		return func(r *http.Request) bool {
+			return r.URL.Query().Get(name) == options[0]
+		}, nil
+	},
+	"cookie_val": func(value interface{}, options []string) (aclMatcher, error) {
+		name, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(options) == 0 {
+			return nil, fmt.Errorf("the expected value is required as first option")
+		}
+		return func(r *http.Request) bool {
+			cookie, err := r.Cookie(name)
+			return err == nil && cookie.Value == options[0]
+		}, nil
+	},
+	"ip_src": func(value interface{}, options []string) (aclMatcher, error) {
+		expected, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		overrideHeader := firstOption(options)
+		return func(r *http.Request) bool {
+			return getEffectiveClientIP(r, overrideHeader) == expected
+		}, nil
+	},
+	"ip_src_range": func(value interface{}, options []string) (aclMatcher, error) {
+		expected, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		_, ipNet, err := net.ParseCIDR(expected)
+		if err != nil && net.ParseIP(expected) == nil {
+			return nil, fmt.Errorf("invalid IP range %q", expected)
+		}
+		overrideHeader := firstOption(options)
+		return func(r *http.Request) bool {
+			clientIP := strings.Split(getEffectiveClientIP(r, overrideHeader), ":")[0]
+			if ipNet == nil {
+				return clientIP == expected
+			}
+			ip := net.ParseIP(clientIP)
+			return ip != nil && ipNet.Contains(ip)
+		}, nil
+	},
+	"host":     hostCondition(func(r *http.Request) string { return r.Host }),
+	"host_reg": regexCondition(func(r *http.Request) string { return stripPort(r.Host) }),
+	"sni": hostCondition(func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return r.TLS.ServerName
+	}),
+	"header_reg": func(value interface{}, options []string) (aclMatcher, error) {
+		if len(options) == 0 {
+			return nil, fmt.Errorf("the header name is required as first option")
+		}
+		return regexCondition(func(r *http.Request) string { return r.Header.Get(options[0]) })(value, options)
+	},
+	"header_present": stringCondition(func(r *http.Request, value string) bool {
+		_, ok := r.Header[http.CanonicalHeaderKey(value)]
+		return ok
+	}),
+	"user_agent": stringCondition(func(r *http.Request, value string) bool {
+		return strings.Contains(strings.ToLower(r.UserAgent()), strings.ToLower(value))
+	}),
+	"user_agent_reg": regexCondition(func(r *http.Request) string { return r.UserAgent() }),
+	"query_reg":      regexCondition(func(r *http.Request) string { return r.URL.RawQuery }),
+	"content_type": func(value interface{}, options []string) (aclMatcher, error) {
+		expected, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		expected = strings.ToLower(strings.TrimSpace(expected))
+		if !strings.Contains(expected, "/") {
+			return nil, fmt.Errorf("invalid media type %q, expected e.g. application/json or text/*", expected)
+		}
+		return func(r *http.Request) bool {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				return false
+			}
+			if prefix, ok := strings.CutSuffix(expected, "/*"); ok {
+				return strings.HasPrefix(mediaType, prefix+"/")
+			}
+			return mediaType == expected
+		}, nil
+	},
+	// The size announced by Content-Length; requests of unknown size
+	// (chunked) never match.
+	"req_size": comparisonCondition(parseByteSize, func(r *http.Request) (int64, bool) {
+		return r.ContentLength, r.ContentLength >= 0
+	}),
+	"tls_version": comparisonCondition(parseTLSVersion, func(r *http.Request) (int64, bool) {
+		if r.TLS == nil {
+			return 0, false
+		}
+		return int64(r.TLS.Version), true
+	}),
+	"tls_cipher": func(value interface{}, options []string) (aclMatcher, error) {
+		name, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		return func(r *http.Request) bool {
+			return r.TLS != nil && r.TLS.CipherSuite == id
+		}, nil
+	},
+	"http_version": comparisonCondition(parseHTTPVersion, func(r *http.Request) (int64, bool) {
+		return int64(r.ProtoMajor*10 + r.ProtoMinor), true
+	}),
+	"session_id": stringCondition(func(r *http.Request, value string) bool {
+		claims, err := getSessionClaims(r)
+		return err == nil && claims.SessionID == value
+	}),
+	"session_age": comparisonCondition(parseDurationValue, func(r *http.Request) (int64, bool) {
+		claims, err := getSessionClaims(r)
+		if err != nil {
+			return 0, false
+		}
+		return int64(claims.sessionAge()), true
+	}),
+	"method_path_beg": func(value interface{}, options []string) (aclMatcher, error) {
+		var values map[string]interface{}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			values = v
+		case map[interface{}]interface{}:
+			values, _ = normalizeValue(v).(map[string]interface{})
+		}
+		method, okMethod := values["method"].(string)
+		path, okPath := values["path"].(string)
+		if !okMethod || !okPath {
+			return nil, fmt.Errorf("the value must be a map with method and path")
+		}
+		return func(r *http.Request) bool {
+			return r.Method == method && strings.HasPrefix(r.URL.Path, path)
+		}, nil
+	},
+}
+
+// stringCondition builds conditions whose value is a single string.
+func stringCondition(match func(r *http.Request, value string) bool) func(interface{}, []string) (aclMatcher, error) {
+	return func(value interface{}, options []string) (aclMatcher, error) {
+		expected, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) bool { return match(r, expected) }, nil
+	}
+}
+
+// regexCondition builds conditions matching a regular expression against
+// the string returned by subject.
+func regexCondition(subject func(r *http.Request) string) func(interface{}, []string) (aclMatcher, error) {
+	return func(value interface{}, options []string) (aclMatcher, error) {
+		pattern, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+		}
+		return func(r *http.Request) bool { return re.MatchString(subject(r)) }, nil
+	}
+}
+
+func aclStringValue(value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("a string value is required, got %T", value)
+	}
+	return s, nil
+}
+
+func firstOption(options []string) string {
+	if len(options) > 0 {
+		return options[0]
+	}
+	return ""
+}
+
+// hostCondition builds conditions matching a host name, ignoring case and
+// port. A value starting with "*." matches every subdomain.
+func hostCondition(subject func(r *http.Request) string) func(interface{}, []string) (aclMatcher, error) {
+	return func(value interface{}, options []string) (aclMatcher, error) {
+		expected, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		expected = strings.ToLower(expected)
+		suffix, wildcard := strings.CutPrefix(expected, "*")
+		return func(r *http.Request) bool {
+			host := strings.ToLower(stripPort(subject(r)))
+			if wildcard {
+				return strings.HasSuffix(host, suffix)
+			}
+			return host == expected
+		}, nil
+	}
+}
+
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// aclComparisons maps the operators accepted in front of numeric values,
+// e.g. "> 1M" or "ge 1.2". A value without operator tests equality.
+var aclComparisons = map[string]func(a, b int64) bool{
+	"<":  func(a, b int64) bool { return a < b },
+	"<=": func(a, b int64) bool { return a <= b },
+	">":  func(a, b int64) bool { return a > b },
+	">=": func(a, b int64) bool { return a >= b },
+	"=":  func(a, b int64) bool { return a == b },
+	"==": func(a, b int64) bool { return a == b },
+	"!=": func(a, b int64) bool { return a != b },
+	"lt": func(a, b int64) bool { return a < b },
+	"le": func(a, b int64) bool { return a <= b },
+	"gt": func(a, b int64) bool { return a > b },
+	"ge": func(a, b int64) bool { return a >= b },
+	"eq": func(a, b int64) bool { return a == b },
+	"ne": func(a, b int64) bool { return a != b },
+}
+
+// comparisonCondition builds conditions comparing a property of the request
+// with the value. subject reports false when the request has no such
+// property, which never matches.
+func comparisonCondition(parse func(string) (int64, error), subject func(r *http.Request) (int64, bool)) func(interface{}, []string) (aclMatcher, error) {
+	return func(value interface{}, options []string) (aclMatcher, error) {
+		expression, err := aclStringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		compare, operand := aclComparisons["="], strings.TrimSpace(expression)
+		for _, op := range []string{"<=", ">=", "!=", "==", "<", ">", "="} {
+			if rest, ok := strings.CutPrefix(operand, op); ok {
+				compare, operand = aclComparisons[op], strings.TrimSpace(rest)
+				break
+			}
+		}
+		if fields := strings.Fields(operand); len(fields) == 2 && aclComparisons[strings.ToLower(fields[0])] != nil {
+			compare, operand = aclComparisons[strings.ToLower(fields[0])], fields[1]
+		}
+		expected, err := parse(operand)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) bool {
+			actual, ok := subject(r)
+			return ok && compare(actual, expected)
+		}, nil
+	}
+}
+
+// parseByteSize accepts a number of bytes with an optional K, M or G suffix.
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-min(len(value), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+func parseDurationValue(value string) (int64, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return int64(d), nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion accepts 1.2, TLS1.2 or TLSv1.2.
+func parseTLSVersion(value string) (int64, error) {
+	version := strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(value), "TLS"), "V")
+	id, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0 to 1.3", value)
+	}
+	return int64(id), nil
+}
+
+// parseHTTPVersion accepts 1.0, 1.1, 2 or 3, optionally prefixed with HTTP/.
+func parseHTTPVersion(value string) (int64, error) {
+	major, minor, ok := http.ParseHTTPVersion("HTTP/" + strings.TrimPrefix(strings.ToUpper(value), "HTTP/"))
+	if !ok {
+		if n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(value), "HTTP/")); err == nil && n >= 2 {
+			return int64(n * 10), nil
+		}
+		return 0, fmt.Errorf("unknown HTTP version %q", value)
+	}
+	return int64(major*10 + minor), nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if strings.EqualFold(suite.Name, name) {
+				return suite.ID, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// aclRequest builds a plain HTTP request (r.TLS is nil) and lets edit set
+// the properties under test.
+func aclRequest(target string, edit func(r *http.Request)) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if edit != nil {
+		edit(r)
+	}
+	return r
+}
+
+func withHeader(name, value string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set(name, value) }
+}
+
+func withTLS(state tls.ConnectionState) func(r *http.Request) {
+	return func(r *http.Request) { r.TLS = &state }
+}
+
+func withSession(t *testing.T, sessionID string, issuedAt time.Time, key []byte) func(r *http.Request) {
+	t.Helper()
+	claims := &Claims{
+		SessionID: sessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        sessionID,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(jwtTTL).Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("sign session token: %v", err)
+	}
+	return func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session_token", Value: token}) }
+}
+
+func TestACLConditions(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name      string
+		condition string
+		value     interface{}
+		options   []string
+		request   *http.Request
+		want      bool
+	}{
+		{"host", "host", "example.com", nil, aclRequest("http://Example.COM:8443/", nil), true},
+		{"host other", "host", "example.com", nil, aclRequest("http://api.example.com/", nil), false},
+		{"host wildcard", "host", "*.example.com", nil, aclRequest("http://api.Example.com/", nil), true},
+		{"host wildcard apex", "host", "*.example.com", nil, aclRequest("http://example.com/", nil), false},
+		{"host_reg", "host_reg", `^api\.`, nil, aclRequest("http://api.example.com:443/", nil), true},
+		{"host_reg port stripped", "host_reg", `\.com$`, nil, aclRequest("http://api.example.com:443/", nil), true},
+
+		{"sni", "sni", "example.com", nil, aclRequest("http://x/", withTLS(tls.ConnectionState{ServerName: "EXAMPLE.com"})), true},
+		{"sni wildcard", "sni", "*.example.com", nil, aclRequest("http://x/", withTLS(tls.ConnectionState{ServerName: "a.example.com"})), true},
+		{"sni other", "sni", "example.com", nil, aclRequest("http://x/", withTLS(tls.ConnectionState{ServerName: "example.org"})), false},
+		{"sni without tls", "sni", "example.com", nil, aclRequest("http://example.com/", nil), false},
+
+		{"header", "header", "yes", []string{"X-Debug"}, aclRequest("/", withHeader("X-Debug", " Yes ")), true},
+		{"header other value", "header", "yes", []string{"X-Debug"}, aclRequest("/", withHeader("X-Debug", "no")), false},
+		{"header missing", "header", "yes", []string{"X-Debug"}, aclRequest("/", nil), false},
+		{"header_reg", "header_reg", "^Bearer ", []string{"Authorization"}, aclRequest("/", withHeader("Authorization", "Bearer abc")), true},
+		{"header_reg missing", "header_reg", "^Bearer ", []string{"Authorization"}, aclRequest("/", nil), false},
+		{"header_present", "header_present", "x-forwarded-for", nil, aclRequest("/", withHeader("X-Forwarded-For", "")), true},
+		{"header_present missing", "header_present", "X-Forwarded-For", nil, aclRequest("/", nil), false},
+
+		{"user_agent", "user_agent", "curl", nil, aclRequest("/", withHeader("User-Agent", "Curl/8.4.0")), true},
+		{"user_agent other", "user_agent", "curl", nil, aclRequest("/", withHeader("User-Agent", "Mozilla/5.0")), false},
+		{"user_agent missing", "user_agent", "curl", nil, aclRequest("/", nil), false},
+		{"user_agent_reg", "user_agent_reg", "^Mozilla/", nil, aclRequest("/", withHeader("User-Agent", "Mozilla/5.0")), true},
+		{"user_agent_reg missing", "user_agent_reg", "^Mozilla/", nil, aclRequest("/", nil), false},
+		{"query_reg", "query_reg", "(^|&)debug=1", nil, aclRequest("/?a=b&debug=1", nil), true},
+		{"query_reg without query", "query_reg", "(^|&)debug=1", nil, aclRequest("/", nil), false},
+
+		{"content_type", "content_type", "application/json", nil, aclRequest("/", withHeader("Content-Type", "Application/JSON; charset=utf-8")), true},
+		{"content_type other", "content_type", "application/json", nil, aclRequest("/", withHeader("Content-Type", "text/html")), false},
+		{"content_type wildcard", "content_type", "text/*", nil, aclRequest("/", withHeader("Content-Type", "text/plain")), true},
+		{"content_type wildcard other", "content_type", "text/*", nil, aclRequest("/", withHeader("Content-Type", "textual/plain")), false},
+		{"content_type missing", "content_type", "application/json", nil, aclRequest("/", nil), false},
+		{"content_type invalid", "content_type", "application/json", nil, aclRequest("/", withHeader("Content-Type", ";;")), false},
+
+		{"req_size greater", "req_size", "> 1K", nil, aclRequest("/", func(r *http.Request) { r.ContentLength = 2048 }), true},
+		{"req_size smaller", "req_size", "> 1K", nil, aclRequest("/", func(r *http.Request) { r.ContentLength = 100 }), false},
+		{"req_size equal bound", "req_size", "<= 100", nil, aclRequest("/", func(r *http.Request) { r.ContentLength = 100 }), true},
+		{"req_size word operator", "req_size", "ge 1M", nil, aclRequest("/", func(r *http.Request) { r.ContentLength = 1 << 20 }), true},
+		{"req_size without operator", "req_size", "0", nil, aclRequest("/", nil), true},
+		{"req_size unknown length", "req_size", ">= 0", nil, aclRequest("/", func(r *http.Request) { r.ContentLength = -1 }), false},
+
+		{"tls_version", "tls_version", ">= 1.2", nil, aclRequest("/", withTLS(tls.ConnectionState{Version: tls.VersionTLS13})), true},
+		{"tls_version older", "tls_version", ">= 1.2", nil, aclRequest("/", withTLS(tls.ConnectionState{Version: tls.VersionTLS10})), false},
+		{"tls_version prefixed", "tls_version", "TLSv1.3", nil, aclRequest("/", withTLS(tls.ConnectionState{Version: tls.VersionTLS13})), true},
+		{"tls_version without tls", "tls_version", "< 1.3", nil, aclRequest("/", nil), false},
+		{"tls_cipher", "tls_cipher", "tls_aes_128_gcm_sha256", nil, aclRequest("/", withTLS(tls.ConnectionState{CipherSuite: tls.TLS_AES_128_GCM_SHA256})), true},
+		{"tls_cipher other", "tls_cipher", "TLS_AES_128_GCM_SHA256", nil, aclRequest("/", withTLS(tls.ConnectionState{CipherSuite: tls.TLS_AES_256_GCM_SHA384})), false},
+		{"tls_cipher without tls", "tls_cipher", "TLS_AES_128_GCM_SHA256", nil, aclRequest("/", nil), false},
+		{"ssl", "ssl", nil, nil, aclRequest("/", withTLS(tls.ConnectionState{})), true},
+		{"ssl without tls", "ssl", nil, nil, aclRequest("/", nil), false},
+
+		{"http_version", "http_version", ">= 2", nil, aclRequest("/", func(r *http.Request) { r.ProtoMajor, r.ProtoMinor = 2, 0 }), true},
+		{"http_version older", "http_version", ">= 2", nil, aclRequest("/", nil), false},
+		{"http_version exact", "http_version", "HTTP/1.1", nil, aclRequest("/", nil), true},
+		{"http_version 1.0", "http_version", "1.0", nil, aclRequest("/", func(r *http.Request) { r.ProtoMajor, r.ProtoMinor = 1, 0 }), true},
+
+		{"session_id", "session_id", "s1", nil, aclRequest("/", withSession(t, "s1", now, jwtKey)), true},
+		{"session_id other", "session_id", "s1", nil, aclRequest("/", withSession(t, "s2", now, jwtKey)), false},
+		{"session_id forged", "session_id", "s1", nil, aclRequest("/", withSession(t, "s1", now, []byte("other key"))), false},
+		{"session_id without cookie", "session_id", "s1", nil, aclRequest("/", nil), false},
+		{"session_age", "session_age", "> 1h", nil, aclRequest("/", withSession(t, "s1", now.Add(-2*time.Hour), jwtKey)), true},
+		{"session_age recent", "session_age", "> 1h", nil, aclRequest("/", withSession(t, "s1", now, jwtKey)), false},
+		{"session_age without cookie", "session_age", "< 1h", nil, aclRequest("/", nil), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			matcher, err := aclConditions[c.condition](c.value, c.options)
+			if err != nil {
+				t.Fatalf("%s %v: %v", c.condition, c.value, err)
+			}
+			if got := matcher(c.request); got != c.want {
+				t.Fatalf("%s %v = %t, want %t", c.condition, c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestACLConditionErrors(t *testing.T) {
+	cases := []struct {
+		condition string
+		value     interface{}
+		options   []string
+		err       string
+	}{
+		{"host", 1, nil, "a string value is required"},
+		{"host_reg", "(", nil, "invalid regular expression"},
+		{"header", "yes", nil, "the header name is required"},
+		{"header_reg", "^a", nil, "the header name is required"},
+		{"user_agent_reg", "[", nil, "invalid regular expression"},
+		{"content_type", "json", nil, "invalid media type"},
+		{"req_size", "> lots", nil, "invalid size"},
+		{"req_size", "", nil, "invalid size"},
+		{"req_size", "-1", nil, "invalid size"},
+		{"tls_version", "1.4", nil, "unknown TLS version"},
+		{"tls_cipher", "TLS_NOPE", nil, "unknown cipher suite"},
+		{"http_version", "abc", nil, "unknown HTTP version"},
+		{"session_id", nil, nil, "a string value is required"},
+		{"session_age", "> soon", nil, "invalid duration"},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s %v", c.condition, c.value), func(t *testing.T) {
+			_, err := aclConditions[c.condition](c.value, c.options)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s %v error = %v, want %q", c.condition, c.value, err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// compiledACL is a rule set ready to be evaluated.
+type compiledACL struct {
+	named []aclMatcher
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	ACLRule
+	match aclExpr
+}
+
+// aclEval holds the request being evaluated and the result of each named
+// condition, which is computed at most once per request.
+type aclEval struct {
+	r       *http.Request
+	results []int8 // 0: not evaluated, 1: matched, -1: not matched
+}
+
+type aclExpr func(e *aclEval) bool
+
+// compileACL compiles the named conditions (entries with acl set) and the
+// rules. A rule either tests its own condition, or combines named
+// conditions in its if expression, e.g. "admin_path !internal_net".
+func compileACL(rules []ACLRule) (*compiledACL, error) {
+	compiled := &compiledACL{}
+	names := make(map[string]int)
+	for i, rule := range rules {
+		if rule.ACL == "" {
+			continue
+		}
+		if !aclNamePattern.MatchString(rule.ACL) || aclOperators[strings.ToLower(rule.ACL)] {
+			return nil, fmt.Errorf("acl #%d: invalid name %q", i+1, rule.ACL)
+		}
+		if _, ok := names[rule.ACL]; ok {
+			return nil, fmt.Errorf("acl %s: defined twice", rule.ACL)
+		}
+		if rule.Action != "" || rule.If != "" {
+			return nil, fmt.Errorf("acl %s: a named condition has no action or if", rule.ACL)
+		}
+		matcher, err := compileACLCondition(rule)
+		if err != nil {
+			return nil, fmt.Errorf("acl %s: %v", rule.ACL, err)
+		}
+		names[rule.ACL] = len(compiled.named)
+		compiled.named = append(compiled.named, matcher)
+	}
+
+	for i, rule := range rules {
+		if rule.ACL != "" {
+			continue
+		}
+		name := aclRuleKey(i, rule)
+		if err := validateACLAction(rule); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		var match aclExpr
+		switch {
+		case rule.If != "" && rule.Condition != "":
+			return nil, fmt.Errorf("rule %s: condition and if are mutually exclusive", name)
+		case rule.If != "":
+			expr, err := parseACLExpr(rule.If, names, compiled.named)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", name, err)
+			}
+			match = expr
+		default:
+			matcher, err := compileACLCondition(rule)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", name, err)
+			}
+			match = func(e *aclEval) bool { return matcher(e.r) }
+		}
+		compiled.rules = append(compiled.rules, compiledRule{ACLRule: rule, match: match})
+	}
+	return compiled, nil
+}
+
+func compileACLCondition(rule ACLRule) (aclMatcher, error) {
+	if rule.Condition == "" {
+		return nil, fmt.Errorf("missing condition")
+	}
+	build, ok := aclConditions[rule.Condition]
+	if !ok {
+		return nil, fmt.Errorf("unknown condition %q", rule.Condition)
+	}
+	matcher, err := build(rule.Value, rule.Options)
+	if err != nil {
+		return nil, fmt.Errorf("condition %s: %v", rule.Condition, err)
+	}
+	return matcher, nil
+}
+
+func validateACLAction(rule ACLRule) error {
+	switch rule.Action {
+	case "allow", "deny":
+	case "redirect":
+		if len(rule.Options) == 0 {
+			return fmt.Errorf("redirect action requires the target URL as first option")
+		}
+	case "":
+		return fmt.Errorf("missing action")
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+	return nil
+}
+
+// match returns the first rule matching the request.
+func (acl *compiledACL) match(r *http.Request) (*compiledRule, bool) {
+	e := &aclEval{r: r, results: make([]int8, len(acl.named))}
+	for i := range acl.rules {
+		if acl.rules[i].match(e) {
+			return &acl.rules[i], true
+		}
+	}
+	return nil, false
+}
+
+var (
+	aclNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+	aclOperators   = map[string]bool{"and": true, "or": true, "not": true}
+)
+
+// parseACLExpr parses an if expression. As in HAProxy, juxtaposed conditions
+// are ANDed, "or" (or "||") separates alternatives and "!" negates the next
+// condition; "and", "&&", "not" and parentheses are also accepted. AND binds
+// tighter than OR.
+func parseACLExpr(expression string, names map[string]int, named []aclMatcher) (aclExpr, error) {
+	tokens, err := tokenizeACLExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &aclExprParser{tokens: tokens, names: names, named: named}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.pos], expression)
+	}
+	return expr, nil
+}
+
+func tokenizeACLExpr(expression string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expression); {
+		switch c := expression[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expression[i:], "||") || strings.HasPrefix(expression[i:], "&&"):
+			tokens = append(tokens, expression[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(expression) && strings.IndexByte(" \t!()|&", expression[j]) < 0 {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q in %q", expression[i], expression)
+			}
+			tokens = append(tokens, expression[i:j])
+			i = j
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty if expression")
+	}
+	return tokens, nil
+}
+
+type aclExprParser struct {
+	tokens []string
+	pos    int
+	names  map[string]int
+	named  []aclMatcher
+}
+
+func (p *aclExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *aclExprParser) parseOr() (aclExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *aclEval) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (p *aclExprParser) parseAnd() (aclExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "and", "&&":
+			p.pos++
+		case "", "or", "||", ")":
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *aclEval) bool { return l(e) && right(e) }
+	}
+}
+
+func (p *aclExprParser) parseNot() (aclExpr, error) {
+	switch token := p.peek(); token {
+	case "!", "not":
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *aclEval) bool { return !operand(e) }, nil
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	case "", ")", "and", "&&", "or", "||":
+		if token == "" {
+			return nil, fmt.Errorf("incomplete if expression")
+		}
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	name := p.tokens[p.pos]
+	index, ok := p.names[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown acl %q", name)
+	}
+	p.pos++
+	matcher := p.named[index]
+	return func(e *aclEval) bool {
+		if e.results[index] == 0 {
+			e.results[index] = -1
+			if matcher(e.r) {
+				e.results[index] = 1
+			}
+		}
+		return e.results[index] == 1
+	}, nil
+}
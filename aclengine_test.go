@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testACLNames defines the named conditions a and c, which match, and b and
+// d, which do not.
+func testACLNames() (map[string]int, []aclMatcher) {
+	matches := func(result bool) aclMatcher { return func(r *http.Request) bool { return result } }
+	names := map[string]int{"a": 0, "b": 1, "c": 2, "d": 3}
+	return names, []aclMatcher{matches(true), matches(false), matches(true), matches(false)}
+}
+
+func TestParseACLExpr(t *testing.T) {
+	cases := []struct {
+		expression string
+		want       bool
+		err        string
+	}{
+		{expression: "a", want: true},
+		{expression: "b", want: false},
+		{expression: "a c", want: true},
+		{expression: "a b", want: false},
+		{expression: "a and c", want: true},
+		{expression: "a && b", want: false},
+		{expression: "b or a", want: true},
+		{expression: "b || d", want: false},
+		{expression: "a OR b", want: true},
+		{expression: "!b", want: true},
+		{expression: "not a", want: false},
+		{expression: "!!a", want: true},
+		{expression: "! a", want: false},
+
+		// AND binds tighter than OR, and NOT tighter than both.
+		{expression: "a or b d", want: true},
+		{expression: "a or b and d", want: true},
+		{expression: "b d or a", want: true},
+		{expression: "b or a d", want: false},
+		{expression: "!a or c", want: true},
+		{expression: "!a c", want: false},
+
+		// Parentheses override precedence.
+		{expression: "(a or b) d", want: false},
+		{expression: "(a or b) and (c or d)", want: true},
+		{expression: "!(a or b)", want: false},
+		{expression: "!(b d)", want: true},
+		{expression: "a && (b || c)", want: true},
+		{expression: "((a))", want: true},
+
+		{expression: "", err: "empty if expression"},
+		{expression: "  ", err: "empty if expression"},
+		{expression: "x", err: `unknown acl "x"`},
+		{expression: "a or x", err: `unknown acl "x"`},
+		{expression: "a or", err: "incomplete if expression"},
+		{expression: "!", err: "incomplete if expression"},
+		{expression: "or a", err: `unexpected "or"`},
+		{expression: "a and and c", err: `unexpected "and"`},
+		{expression: "(a", err: "missing closing parenthesis"},
+		{expression: "a)", err: `unexpected ")"`},
+		{expression: "()", err: `unexpected ")"`},
+		{expression: "a | c", err: "unexpected"},
+		{expression: "a & c", err: "unexpected"},
+	}
+	names, named := testACLNames()
+	for _, c := range cases {
+		t.Run(c.expression, func(t *testing.T) {
+			expr, err := parseACLExpr(c.expression, names, named)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("parseACLExpr(%q) error = %v, want %q", c.expression, err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseACLExpr(%q): %v", c.expression, err)
+			}
+			e := &aclEval{r: httptest.NewRequest(http.MethodGet, "/", nil), results: make([]int8, len(named))}
+			if got := expr(e); got != c.want {
+				t.Fatalf("%q = %t, want %t", c.expression, got, c.want)
+			}
+		})
+	}
+}
+
+// TestParseACLExprEvaluatesNamedConditionsOnce checks that a named condition
+// referenced several times is evaluated once per request.
+func TestParseACLExprEvaluatesNamedConditionsOnce(t *testing.T) {
+	calls := 0
+	names := map[string]int{"a": 0}
+	named := []aclMatcher{func(r *http.Request) bool { calls++; return false }}
+	expr, err := parseACLExpr("a or !a a or a", names, named)
+	if err != nil {
+		t.Fatalf("parseACLExpr: %v", err)
+	}
+	e := &aclEval{r: httptest.NewRequest(http.MethodGet, "/", nil), results: make([]int8, len(named))}
+	expr(e)
+	if calls != 1 {
+		t.Fatalf("named condition evaluated %d times, want 1", calls)
+	}
+}
+
+func TestCompileACLErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []ACLRule
+		err   string
+	}{
+		{
+			name:  "unknown condition",
+			rules: []ACLRule{{Name: "r", Condition: "path_begins", Value: "/", Action: "allow"}},
+			err:   `rule r: unknown condition "path_begins"`,
+		},
+		{
+			name:  "missing condition",
+			rules: []ACLRule{{Name: "r", Action: "allow"}},
+			err:   "rule r: missing condition",
+		},
+		{
+			name:  "missing action",
+			rules: []ACLRule{{Name: "r", Condition: "always"}},
+			err:   "rule r: missing action",
+		},
+		{
+			name:  "unknown action",
+			rules: []ACLRule{{Name: "r", Condition: "always", Action: "drop"}},
+			err:   `rule r: unknown action "drop"`,
+		},
+		{
+			name:  "redirect without target",
+			rules: []ACLRule{{Name: "r", Condition: "always", Action: "redirect"}},
+			err:   "redirect action requires the target URL",
+		},
+		{
+			name:  "invalid value type",
+			rules: []ACLRule{{Name: "r", Condition: "path_beg", Value: 42, Action: "deny"}},
+			err:   "a string value is required",
+		},
+		{
+			name:  "invalid regular expression",
+			rules: []ACLRule{{Name: "r", Condition: "path_reg", Value: "(", Action: "deny"}},
+			err:   "invalid regular expression",
+		},
+		{
+			name:  "invalid IP range",
+			rules: []ACLRule{{Name: "r", Condition: "ip_src_range", Value: "10.0.0.0/33", Action: "deny"}},
+			err:   "invalid IP range",
+		},
+		{
+			name:  "condition and if",
+			rules: []ACLRule{{ACL: "a", Condition: "always"}, {Name: "r", If: "a", Condition: "always", Action: "deny"}},
+			err:   "condition and if are mutually exclusive",
+		},
+		{
+			name:  "if with unknown acl",
+			rules: []ACLRule{{ACL: "a", Condition: "always"}, {Name: "r", If: "a missing", Action: "deny"}},
+			err:   `rule r: unknown acl "missing"`,
+		},
+		{
+			name:  "if with syntax error",
+			rules: []ACLRule{{ACL: "a", Condition: "always"}, {Name: "r", If: "(a", Action: "deny"}},
+			err:   "rule r: missing closing parenthesis",
+		},
+		{
+			name:  "acl defined twice",
+			rules: []ACLRule{{ACL: "a", Condition: "always"}, {ACL: "a", Condition: "ssl"}},
+			err:   "acl a: defined twice",
+		},
+		{
+			name:  "acl named like an operator",
+			rules: []ACLRule{{ACL: "Or", Condition: "always"}},
+			err:   `invalid name "Or"`,
+		},
+		{
+			name:  "acl with invalid name",
+			rules: []ACLRule{{ACL: "admin path", Condition: "always"}},
+			err:   `invalid name "admin path"`,
+		},
+		{
+			name:  "acl with an action",
+			rules: []ACLRule{{ACL: "a", Condition: "always", Action: "deny"}},
+			err:   "acl a: a named condition has no action or if",
+		},
+		{
+			name:  "acl with an invalid condition",
+			rules: []ACLRule{{ACL: "a", Condition: "nope"}},
+			err:   `acl a: unknown condition "nope"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := compileACL(c.rules)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("compileACL error = %v, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestCompiledACLMatch(t *testing.T) {
+	rules := []ACLRule{
+		{ACL: "admin", Condition: "path_beg", Value: "/admin"},
+		{ACL: "internal", Condition: "ip_src_range", Value: "10.0.0.0/8"},
+		{ACL: "write", Condition: "method", Value: "POST"},
+		{Name: "block-admin", If: "admin !internal", Action: "deny"},
+		{Name: "redirect-writes", If: "write (admin or internal)", Action: "redirect", Options: []string{"/read-only"}},
+		{Name: "allow-all", Condition: "always", Action: "allow"},
+	}
+	compiled, err := compileACL(rules)
+	if err != nil {
+		t.Fatalf("compileACL: %v", err)
+	}
+
+	cases := []struct {
+		method, path, remote string
+		want                 string
+	}{
+		{http.MethodGet, "/admin/users", "203.0.113.7:4000", "block-admin"},
+		{http.MethodGet, "/admin/users", "10.1.2.3:4000", "allow-all"},
+		{http.MethodPost, "/admin/users", "10.1.2.3:4000", "redirect-writes"},
+		{http.MethodPost, "/public", "10.1.2.3:4000", "redirect-writes"},
+		{http.MethodPost, "/public", "203.0.113.7:4000", "allow-all"},
+		{http.MethodGet, "/", "203.0.113.7:4000", "allow-all"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		r.RemoteAddr = c.remote
+		rule, ok := compiled.match(r)
+		if !ok || rule.Name != c.want {
+			t.Errorf("%s %s from %s matched %v, want %s", c.method, c.path, c.remote, rule, c.want)
+		}
+	}
+}
+
+func TestLoadACLConfigCompilesRules(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	os.WriteFile(valid, []byte(`rules:
+  - acl: api
+    condition: path_beg
+    value: /api
+  - name: deny-api
+    if: "!api or api"
+    action: deny
+`), 0o644)
+	invalid := filepath.Join(dir, "invalid.yaml")
+	os.WriteFile(invalid, []byte(`rules:
+  - name: deny-api
+    if: api
+    action: deny
+`), 0o644)
+
+	config, err := LoadACLConfig(valid)
+	if err != nil {
+		t.Fatalf("LoadACLConfig(valid): %v", err)
+	}
+	if rule, ok := config.Match(httptest.NewRequest(http.MethodGet, "/", nil)); !ok || rule.Name != "deny-api" {
+		t.Fatalf("Match = %v, %t, want deny-api", rule, ok)
+	}
+
+	if _, err := LoadACLConfig(invalid); err == nil || !strings.Contains(err.Error(), `unknown acl "api"`) {
+		t.Fatalf("LoadACLConfig(invalid) error = %v, want unknown acl", err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ACLVersion is one version of the ACL rule set in the history. Diff is
+// relative to the version it replaced.
+type ACLVersion struct {
+	Version   int64     `json:"version"`
+	Author    string    `json:"author"`
+	Reason    string    `json:"reason"`
+	NodeID    string    `json:"node_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Diff      ACLDiff   `json:"diff"`
+	Rules     []ACLRule `json:"rules,omitempty"`
+}
+
+// ACLDiff lists the rules that differ between two rule sets, matched by
+// name or ACL name (or by position for unnamed rules). Reordered is set when the rules
+// present in both are not evaluated in the same order.
+type ACLDiff struct {
+	Added     []ACLRule       `json:"added,omitempty"`
+	Removed   []ACLRule       `json:"removed,omitempty"`
+	Modified  []ACLRuleChange `json:"modified,omitempty"`
+	Reordered bool            `json:"reordered,omitempty"`
+}
+
+// ACLRuleChange is a rule modified between two versions.
+type ACLRuleChange struct {
+	Name   string  `json:"name"`
+	Before ACLRule `json:"before"`
+	After  ACLRule `json:"after"`
+}
+
+func (d ACLDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && !d.Reordered
+}
+
+func (d ACLDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	summary := fmt.Sprintf("%d added, %d removed, %d modified", len(d.Added), len(d.Removed), len(d.Modified))
+	if d.Reordered {
+		summary += ", reordered"
+	}
+	return summary
+}
+
+// diffACLRules returns the changes that turn old into new.
+func diffACLRules(old, new []ACLRule) ACLDiff {
+	var diff ACLDiff
+	oldRules := make(map[string]ACLRule, len(old))
+	for i, rule := range old {
+		oldRules[aclRuleKey(i, rule)] = rule
+	}
+	newRules := make(map[string]bool, len(new))
+	var common []string
+	for i, rule := range new {
+		key := aclRuleKey(i, rule)
+		newRules[key] = true
+		before, ok := oldRules[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, rule)
+		case !sameACLRule(before, rule):
+			diff.Modified = append(diff.Modified, ACLRuleChange{Name: key, Before: before, After: rule})
+			common = append(common, key)
+		default:
+			common = append(common, key)
+		}
+	}
+	position := 0
+	for i, rule := range old {
+		key := aclRuleKey(i, rule)
+		if !newRules[key] {
+			diff.Removed = append(diff.Removed, rule)
+			continue
+		}
+		if position < len(common) && common[position] != key {
+			diff.Reordered = true
+		}
+		position++
+	}
+	return diff
+}
+
+func aclRuleKey(index int, rule ACLRule) string {
+	if id := rule.ID(); id != "" {
+		return id
+	}
+	return fmt.Sprintf("#%d", index+1)
+}
+
+func sameACLRule(a, b ACLRule) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+// normalizeACLRuleValues returns a copy of the rules whose map values use
+// string keys, as map values decoded from YAML cannot be encoded in JSON.
+func normalizeACLRuleValues(rules []ACLRule) []ACLRule {
+	normalized := make([]ACLRule, len(rules))
+	for i, rule := range rules {
+		if value, ok := rule.Value.(map[interface{}]interface{}); ok {
+			rule.Value = normalizeValue(value)
+		}
+		normalized[i] = rule
+	}
+	return normalized
+}
+
+func aclHistoryKey(version int64) string {
+	return "acl:history:" + strconv.FormatInt(version, 10)
+}
+
+// GetACLVersion returns a version of the history, or nil if it does not
+// exist or was pruned.
+func GetACLVersion(number int64) (*ACLVersion, error) {
+	data, found, err := stateStore.Get(aclHistoryKey(number))
+	if err != nil || !found {
+		return nil, err
+	}
+	return decodeACLVersion(data)
+}
+
+// LatestACLVersion returns the most recent version of the history.
+func LatestACLVersion() (*ACLVersion, error) {
+	versions, err := ListACLVersions(1)
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+	return GetACLVersion(versions[0].Version)
+}
+
+// ListACLVersions returns up to limit versions, newest first, without their
+// rules.
+func ListACLVersions(limit int) ([]ACLVersion, error) {
+	data, found, err := stateStore.Get(aclVersionKey)
+	if err != nil || !found {
+		return nil, err
+	}
+	latest, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACL version counter %q", data)
+	}
+	oldest := int64(1)
+	if aclSync != nil && aclSync.historyMax > 0 && latest > aclSync.historyMax {
+		oldest = latest - aclSync.historyMax + 1
+	}
+
+	versions := []ACLVersion{}
+	for number := latest; number >= oldest && len(versions) < limit; number-- {
+		version, err := GetACLVersion(number)
+		if err != nil {
+			return nil, err
+		}
+		// Versions whose rules could not be persisted leave a gap.
+		if version == nil {
+			continue
+		}
+		version.Rules = nil
+		versions = append(versions, *version)
+	}
+	return versions, nil
+}
+
+// maxACLAuthorLength bounds the author recorded for an API change.
+const maxACLAuthorLength = 64
+
+// aclAuthor returns the author recorded in the ACL history for an API
+// change. Every operator uses the same API key, so the author is whatever
+// the client declares in the X-Author header, or "api" if it declares none.
+func aclAuthor(r *http.Request) string {
+	author := strings.Map(func(c rune) rune {
+		if unicode.IsPrint(c) {
+			return c
+		}
+		return -1
+	}, strings.TrimSpace(r.Header.Get("X-Author")))
+	if author == "" {
+		return "api"
+	}
+	if runes := []rune(author); len(runes) > maxACLAuthorLength {
+		author = string(runes[:maxACLAuthorLength])
+	}
+	return "api:" + author
+}
+
+// handleACLVersions lists the ACL versions, newest first, or returns one
+// version with its rules when its number follows the path
+// (/api/acl/versions/<version>).
+func handleACLVersions(w http.ResponseWriter, r *http.Request) {
+	logAPIRequest(r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if param := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/acl/versions"), "/"); param != "" {
+		number, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		version, ok := aclVersionOrError(w, number)
+		if ok {
+			json.NewEncoder(w).Encode(version)
+		}
+		return
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	versions, err := ListACLVersions(limit)
+	if err != nil {
+		logError("Failed to read ACL history: %v", err)
+		http.Error(w, "Failed to read ACL history", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(versions)
+}
+
+// handleACLDiff returns the changes between two versions, given by the from
+// and to query parameters. to defaults to the latest version.
+func handleACLDiff(w http.ResponseWriter, r *http.Request) {
+	logAPIRequest(r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	from, err := strconv.ParseInt(query.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid or missing from version", http.StatusBadRequest)
+		return
+	}
+	fromVersion, ok := aclVersionOrError(w, from)
+	if !ok {
+		return
+	}
+
+	var toVersion *ACLVersion
+	if value := query.Get("to"); value != "" {
+		to, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid to version", http.StatusBadRequest)
+			return
+		}
+		if toVersion, ok = aclVersionOrError(w, to); !ok {
+			return
+		}
+	} else if toVersion, err = LatestACLVersion(); err != nil || toVersion == nil {
+		http.Error(w, "Failed to read ACL history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from": fromVersion.Version,
+		"to":   toVersion.Version,
+		"diff": diffACLRules(fromVersion.Rules, toVersion.Rules),
+	})
+}
+
+// handleACLRollback makes the rules of a previous version current again.
+// The rollback is recorded as a new version, so it can itself be undone.
+func handleACLRollback(w http.ResponseWriter, r *http.Request) {
+	logAPIRequest(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	number, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid or missing version", http.StatusBadRequest)
+		return
+	}
+	target, ok := aclVersionOrError(w, number)
+	if !ok {
+		return
+	}
+
+	// History entries are not validated when read; updateACL compiles the
+	// rules and rejects a version that no longer compiles with 400.
+	err = updateACL(aclAuthor(r), fmt.Sprintf("rollback to version %d", number), func(config *ACLConfig) error {
+		config.Rules = target.Rules
+		return nil
+	})
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("ACL rolled back to version %d", number)})
+}
+
+// aclVersionOrError returns the version, or writes the error response if it
+// cannot be read.
+func aclVersionOrError(w http.ResponseWriter, number int64) (*ACLVersion, bool) {
+	version, err := GetACLVersion(number)
+	if err != nil {
+		logError("Failed to read ACL version %d: %v", number, err)
+		http.Error(w, "Failed to read ACL history", http.StatusInternalServerError)
+		return nil, false
+	}
+	if version == nil {
+		http.Error(w, fmt.Sprintf("ACL version %d not found", number), http.StatusNotFound)
+		return nil, false
+	}
+	return version, true
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	aclRulesKey       = "acl:rules"
+	aclVersionKey     = "acl:version"
+	aclUpdatesChannel = "acl_updates"
+)
+
+// ACL persistence modes.
+const (
+	ACLPersistNone  = "none"
+	ACLPersistFile  = "file"
+	ACLPersistStore = "store"
+)
+
+// aclSync versions the ACL and, unless persistence is disabled, persists the
+// changes made through the API and applies those of the other instances.
+var aclSync *ACLSync
+
+// ACLSync records every change of the ACL as a version in the state store.
+// In file mode the rule set is also written back to the ACL file; in store
+// mode it is kept in the state store, which then takes precedence over the
+// file at startup. In both modes new versions are published to the other
+// instances.
+type ACLSync struct {
+	store      StateStore
+	mode       string
+	file       string
+	historyMax int64
+
+	mu      sync.Mutex
+	version int64
+	current []ACLRule
+}
+
+func NewACLSync(store StateStore, mode, file string, historyMax int64) (*ACLSync, error) {
+	switch mode {
+	case ACLPersistFile:
+		if file == "" {
+			return nil, fmt.Errorf("ACL persistence to file requires -acl-file")
+		}
+	case ACLPersistStore, ACLPersistNone:
+	default:
+		return nil, fmt.Errorf("unknown ACL persistence mode %q (expected none, file or store)", mode)
+	}
+	return &ACLSync{store: store, mode: mode, file: file, historyMax: historyMax}, nil
+}
+
+// Load makes the latest recorded version current and returns it, or nil if
+// there is none. In store mode it is read from the persisted rule set.
+func (as *ACLSync) Load() (*ACLVersion, error) {
+	var version *ACLVersion
+	if as.mode == ACLPersistStore {
+		data, found, err := as.store.Get(aclRulesKey)
+		if err != nil || !found {
+			return nil, err
+		}
+		if version, err = decodeACLVersion(data); err != nil {
+			return nil, fmt.Errorf("invalid ACL in state store: %v", err)
+		}
+		if err := ValidateACLRules(version.Rules); err != nil {
+			return nil, fmt.Errorf("invalid ACL version %d in state store: %v", version.Version, err)
+		}
+	} else {
+		var err error
+		if version, err = LatestACLVersion(); err != nil || version == nil {
+			return nil, err
+		}
+	}
+	as.mu.Lock()
+	as.version, as.current = version.Version, version.Rules
+	as.mu.Unlock()
+	return version, nil
+}
+
+// Commit records the rule set as a new version, persists it and notifies
+// the other instances. Nothing is recorded if the rules did not change.
+func (as *ACLSync) Commit(rules []ACLRule, author, reason string) error {
+	return as.commit(rules, author, reason, true, true)
+}
+
+// Record records a rule set read from the ACL or configuration file as a new
+// version and notifies the other instances, without writing it back.
+func (as *ACLSync) Record(rules []ACLRule, author, reason string) error {
+	return as.commit(rules, author, reason, false, true)
+}
+
+func (as *ACLSync) commit(rules []ACLRule, author, reason string, persist, publish bool) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	rules = normalizeACLRuleValues(rules)
+	diff := diffACLRules(as.current, rules)
+	if as.current != nil && diff.Empty() {
+		return nil
+	}
+	number, err := as.store.IncrBy(aclVersionKey, 1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to allocate ACL version: %v", err)
+	}
+	version := ACLVersion{
+		Version:   number,
+		Author:    author,
+		Reason:    reason,
+		NodeID:    nodeID,
+		Timestamp: time.Now(),
+		Diff:      diff,
+		Rules:     rules,
+	}
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	if persist {
+		if err := as.persist(string(data), rules); err != nil {
+			return err
+		}
+	}
+	if err := as.store.Set(aclHistoryKey(number), string(data), 0); err != nil {
+		return fmt.Errorf("failed to record ACL version %d: %v", number, err)
+	}
+	if as.historyMax > 0 && number > as.historyMax {
+		if err := as.store.Delete(aclHistoryKey(number - as.historyMax)); err != nil {
+			logWarning("Failed to prune ACL version %d: %v", number-as.historyMax, err)
+		}
+	}
+	as.version, as.current = number, rules
+	logSuccess("ACL version %d recorded by %s: %s (%s)", number, author, reason, diff)
+
+	if publish && as.mode != ACLPersistNone {
+		if err := as.store.Publish(aclUpdatesChannel, string(data)); err != nil {
+			logError("Failed to publish ACL version %d: %v", number, err)
+		}
+	}
+	return nil
+}
+
+func (as *ACLSync) persist(data string, rules []ACLRule) error {
+	switch as.mode {
+	case ACLPersistFile:
+		return writeACLFile(as.file, rules)
+	case ACLPersistStore:
+		return as.store.Set(aclRulesKey, data, 0)
+	}
+	return nil
+}
+
+// Follow applies the rule sets published by the other instances until
+// shutdown.
+func (as *ACLSync) Follow() {
+	messages, unsubscribe := as.store.Subscribe(aclUpdatesChannel)
+	defer unsubscribe()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			as.apply(message)
+		}
+	}
+}
+
+// apply installs a published rule set unless it is older than the current
+// one. Rule sets that do not compile are rejected so a faulty node cannot
+// break the ACL of the others.
+func (as *ACLSync) apply(message string) {
+	version, err := decodeACLVersion(message)
+	if err != nil {
+		logError("Rejected ACL update: %v", err)
+		return
+	}
+	if version.NodeID == nodeID {
+		return
+	}
+
+	// Same lock order as updateACL and swapACLRules, which commit with
+	// aclMutex held.
+	aclMutex.Lock()
+	defer aclMutex.Unlock()
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if version.Version <= as.version {
+		return
+	}
+	if err := aclConfig.SetRules(version.Rules); err != nil {
+		logError("Rejected ACL version %d from %s: %v", version.Version, version.NodeID, err)
+		return
+	}
+	as.version, as.current = version.Version, version.Rules
+	if as.mode == ACLPersistFile {
+		if err := writeACLFile(as.file, version.Rules); err != nil {
+			logError("Failed to write ACL version %d to %s: %v", version.Version, as.file, err)
+		}
+	}
+	logInfo("Applied ACL version %d from %s (%d rules)", version.Version, version.NodeID, len(version.Rules))
+}
+
+// Reconcile applies the rule set of the state store if an update was missed,
+// e.g. while Redis was unreachable.
+func (as *ACLSync) Reconcile() {
+	if as.mode != ACLPersistStore {
+		return
+	}
+	data, found, err := as.store.Get(aclRulesKey)
+	if err != nil {
+		logError("Failed to reconcile ACL with the state store: %v", err)
+		return
+	}
+	if found {
+		as.apply(data)
+	}
+}
+
+// decodeACLVersion parses a version read from the state store or received
+// from another instance. The rules are not validated: history entries are
+// shown as recorded, even if they no longer compile, and the rules are
+// compiled when installed.
+func decodeACLVersion(data string) (*ACLVersion, error) {
+	var version ACLVersion
+	if err := json.Unmarshal([]byte(data), &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// startACLSync versions the ACL loaded from source and, depending on mode,
+// persists API changes and follows those of the other instances. In store
+// mode the rule set of the store replaces the one just loaded, or is
+// initialised from it. Otherwise the loaded rules become a new version if
+// they differ from the last one; it is not published, so a restarting
+// instance does not impose its file on the others.
+func startACLSync(mode, file, source string, historyMax int64) {
+	var err error
+	aclSync, err = NewACLSync(stateStore, mode, file, historyMax)
+	if err != nil {
+		log.Fatalf("Invalid ACL persistence: %v", err)
+	}
+
+	version, err := aclSync.Load()
+	if err != nil {
+		logError("Failed to load the ACL history, using local rules: %v", err)
+	} else if version != nil && mode == ACLPersistStore {
+		if err := aclConfig.SetRules(version.Rules); err != nil {
+			log.Fatalf("Invalid ACL version %d in the state store: %v", version.Version, err)
+		}
+		logInfo("Using ACL version %d from the state store (%d rules)", version.Version, len(version.Rules))
+	} else {
+		if mode == ACLPersistStore {
+			err = aclSync.Commit(aclConfig.GetRules(), source, "initial rules")
+		} else {
+			err = aclSync.commit(aclConfig.GetRules(), source, "loaded at startup", false, false)
+		}
+		if err != nil {
+			logError("Failed to record ACL version: %v", err)
+		}
+	}
+
+	if mode != ACLPersistNone {
+		go aclSync.Follow()
+		if redisMonitor != nil {
+			redisMonitor.OnRecover(aclSync.Reconcile)
+		}
+	}
+}
+
+// writeACLFile replaces the ACL file in a single rename, so readers (and the
+// file watcher) never see a partial file.
+func writeACLFile(path string, rules []ACLRule) error {
+	data, err := yaml.Marshal(&ACLConfig{Rules: rules})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var activeProxyReconciliationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_active_view_reconciliations_total",
+		Help: "Total number of reconciliations of the in-process active proxy with the state store, by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(activeProxyReconciliationsTotal)
+}
+
+// activeProxyView is the process-wide view of the active proxy read on every
+// proxied request.
+var activeProxyView = &ActiveProxyView{}
+
+// ActiveProxyView keeps the active proxy in memory so the request path never
+// waits on the state store. It is fed by the proxy_updates channel and periodically
+// reconciled with the active_proxy key to recover from missed messages.
+type ActiveProxyView struct {
+	value   atomic.Value // string
+	version atomic.Uint64
+
+	mu        sync.Mutex // serializes writers
+	startOnce sync.Once
+}
+
+// Load returns the active proxy and whether one is known yet.
+func (v *ActiveProxyView) Load() (string, bool) {
+	proxy, ok := v.value.Load().(string)
+	return proxy, ok && proxy != ""
+}
+
+// Store records a new active proxy.
+func (v *ActiveProxyView) Store(proxy string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.value.Store(proxy)
+	v.version.Add(1)
+}
+
+// Start loads the active proxy from Redis, then follows proxy_updates and
+// reconciles on every interval. Only the first call has an effect.
+func (v *ActiveProxyView) Start(store StateStore, interval time.Duration) {
+	v.startOnce.Do(func() {
+		v.reconcile(store)
+		go v.follow(store)
+		if interval > 0 {
+			go v.reconcileEvery(store, interval)
+		}
+	})
+}
+
+func (v *ActiveProxyView) follow(store StateStore) {
+	messages, unsubscribe := store.Subscribe(proxyUpdatesChannel)
+	defer unsubscribe()
+
+	for message := range messages {
+		logInfo("Received new proxy update: %s", message)
+		_, proxy := parseProxyUpdate(message)
+		v.Store(proxy)
+	}
+}
+
+func (v *ActiveProxyView) reconcileEvery(store StateStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+			v.reconcile(store)
+		}
+	}
+}
+
+// reconcile replaces the view with the value held by the state store,
+// unless an update arrived while the store was being read.
+func (v *ActiveProxyView) reconcile(store StateStore) {
+	version := v.version.Load()
+	proxy, found, err := store.Get(activeProxyKey)
+	if err != nil {
+		activeProxyReconciliationsTotal.WithLabelValues("error").Inc()
+		logError("Failed to reconcile active proxy with the state store: %v", err)
+		return
+	}
+	if !found {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.version.Load() != version {
+		return
+	}
+	current, _ := v.value.Load().(string)
+	if current == proxy {
+		activeProxyReconciliationsTotal.WithLabelValues("match").Inc()
+		return
+	}
+	if current != "" {
+		logWarning("Active proxy drifted from the state store (%s instead of %s), reconciling", current, proxy)
+	}
+	activeProxyReconciliationsTotal.WithLabelValues("drift").Inc()
+	v.value.Store(proxy)
+	v.version.Add(1)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// BenchmarkActiveProxyLoad compares the in-process view read on every
+// proxied request with the Redis GET it replaced. The GET goes to the Redis
+// at MORPHPROXY_TEST_REDIS when set, or to a minimal in-process Redis over
+// loopback otherwise, so the round trip is measured without a server.
+func BenchmarkActiveProxyLoad(b *testing.B) {
+	const proxy = "https://proxy.example.com:8443"
+
+	b.Run("view", func(b *testing.B) {
+		view := &ActiveProxyView{}
+		view.Store(proxy)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if current, _ := view.Load(); current != proxy {
+					b.Errorf("view returned %q", current)
+				}
+			}
+		})
+	})
+
+	b.Run("redis_get", func(b *testing.B) {
+		addr := os.Getenv("MORPHPROXY_TEST_REDIS")
+		if addr == "" {
+			addr = startFakeRedis(b)
+		}
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		defer client.Close()
+		store := NewRedisStore(client)
+		if err := store.Set(activeProxyKey, proxy, 0); err != nil {
+			b.Fatalf("set active proxy: %v", err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if current, _, err := store.Get(activeProxyKey); err != nil || current != proxy {
+					b.Errorf("GET returned %q, %v", current, err)
+				}
+			}
+		})
+	})
+}
+
+// startFakeRedis serves GET and SET over RESP on a loopback port until the
+// benchmark ends, and returns its address.
+func startFakeRedis(b *testing.B) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen: %v", err)
+	}
+	b.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	values := make(map[string]string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				writer := bufio.NewWriter(conn)
+				for {
+					args, err := readRESPCommand(reader)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "GET":
+						if value, ok := values[args[1]]; ok {
+							fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							writer.WriteString("$-1\r\n")
+						}
+					case "SET":
+						values[args[1]] = args[2]
+						writer.WriteString("+OK\r\n")
+					default:
+						writer.WriteString("+OK\r\n")
+					}
+					mu.Unlock()
+					if writer.Flush() != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// readRESPCommand reads one command sent as an array of bulk strings.
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(header, "*") {
+		return nil, fmt.Errorf("unexpected %q", header)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid array header %q", header)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk header %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
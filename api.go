@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -80,8 +81,27 @@ func setupAPIRoutes(mux *http.ServeMux, proxyManager *ProxyManager, randApikey s
 		apiRouter.HandleFunc("/api/acl", func(w http.ResponseWriter, r *http.Request) {
 			handleACLs(w, r, proxyManager)
 		})
+		apiRouter.HandleFunc("/api/acl/versions", handleACLVersions)
+		apiRouter.HandleFunc("/api/acl/versions/", handleACLVersions)
+		apiRouter.HandleFunc("/api/acl/diff", handleACLDiff)
+		apiRouter.HandleFunc("/api/acl/rollback", handleACLRollback)
 	}
 	apiRouter.HandleFunc("/api/ban_session", handleBanSession)
+	apiRouter.HandleFunc("/api/rotations", handleRotations)
+	apiRouter.HandleFunc("/api/rotation", func(w http.ResponseWriter, r *http.Request) {
+		handleRotation(w, r, proxyManager)
+	})
+	apiRouter.HandleFunc("/api/rotation/", func(w http.ResponseWriter, r *http.Request) {
+		handleRotation(w, r, proxyManager)
+	})
+	apiRouter.HandleFunc("/api/leader", func(w http.ResponseWriter, r *http.Request) {
+		handleLeader(w, r, proxyManager)
+	})
+	apiRouter.HandleFunc("/api/redis", handleRedisStatus)
+	apiRouter.HandleFunc("/api/reload", handleReload)
+	apiRouter.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(w, r, proxyManager)
+	})
 
 	mux.Handle("/api/", rateLimitMiddleware(apiKeyMiddleware(apiRouter)))
 }
@@ -95,8 +115,8 @@ func handleProxies(w http.ResponseWriter, r *http.Request, proxyManager *ProxyMa
 	switch r.Method {
 	case http.MethodGet:
 
-		proxies := proxyManager.ListProxies()
-		json.NewEncoder(w).Encode(proxies)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proxyManager.ListProxies())
 
 	case http.MethodPost:
 
@@ -109,10 +129,21 @@ func handleProxies(w http.ResponseWriter, r *http.Request, proxyManager *ProxyMa
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		proxyManager.AddProxy(proxyConfig.ID, proxyConfig.Address, proxyConfig.BackendURL)
-
-		go StartProxyServer(proxyConfig.ID, proxyConfig.Address, proxyConfig.BackendURL, nil, false, proxyManager)
+		if proxyConfig.ID == "" || proxyConfig.Address == "" {
+			http.Error(w, "Missing proxy ID or address", http.StatusBadRequest)
+			return
+		}
+		if proxyConfig.BackendURL == "" {
+			proxyConfig.BackendURL = backendURLserver
+		}
+		instance, err := proxyManager.AddProxy(proxyConfig.ID, proxyConfig.Address, proxyConfig.BackendURL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(instance)
 
 	case http.MethodDelete:
 
@@ -121,14 +152,137 @@ func handleProxies(w http.ResponseWriter, r *http.Request, proxyManager *ProxyMa
 			http.Error(w, "Missing proxy ID", http.StatusBadRequest)
 			return
 		}
-		proxyManager.RemoveProxy(id)
-		w.WriteHeader(http.StatusNoContent)
+		instance, err := proxyManager.RemoveProxy(id)
+		if _, inUse := err.(proxyInUseError); inUse {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		// The listener drains in the background.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(instance)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// handleHealth returns the health state of every proxy.
+func handleHealth(w http.ResponseWriter, r *http.Request, proxyManager *ProxyManager) {
+	logAPIRequest(r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	proxyManager.mu.Lock()
+	health := proxyManager.health
+	proxyManager.mu.Unlock()
+	if health == nil {
+		http.Error(w, "Health checks disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health.States())
+}
+
+// handleLeader returns the rotation leader election state.
+func handleLeader(w http.ResponseWriter, r *http.Request, proxyManager *ProxyManager) {
+	logAPIRequest(r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	proxyManager.mu.Lock()
+	election := proxyManager.election
+	proxyManager.mu.Unlock()
+
+	status := LeaderStatus{NodeID: nodeID, Leader: nodeID, IsLeader: true}
+	if election != nil {
+		status = election.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleRotation controls rotation at runtime and returns the rotation state:
+//
+//	GET    /api/rotation           current state
+//	POST   /api/rotation/rotate    rotate now
+//	POST   /api/rotation/pin       pin to {"proxy": "<url or port>"}
+//	DELETE /api/rotation/pin       unpin
+//	POST   /api/rotation/pause     pause rotation
+//	POST   /api/rotation/resume    resume rotation
+//	PUT    /api/rotation/interval  set {"interval": "30s", "jitter": "5s"}
+//
+// With leader election, pause, pin and interval changes made on any node are
+// shared with the others and applied by the leader, and rotate is forwarded
+// to the leader.
+func handleRotation(w http.ResponseWriter, r *http.Request, proxyManager *ProxyManager) {
+	logAPIRequest(r)
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/rotation"), "/")
+
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "rotate" && r.Method == http.MethodPost:
+		err = proxyManager.RotateNow()
+	case action == "pin" && r.Method == http.MethodPost:
+		var body struct {
+			Proxy string `json:"proxy"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Proxy == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err = proxyManager.Pin(body.Proxy)
+	case action == "pin" && r.Method == http.MethodDelete:
+		proxyManager.Unpin()
+	case action == "pause" && r.Method == http.MethodPost:
+		proxyManager.SetPaused(true)
+	case action == "resume" && r.Method == http.MethodPost:
+		proxyManager.SetPaused(false)
+	case action == "interval" && r.Method == http.MethodPut:
+		var body struct {
+			Interval string `json:"interval"`
+			Jitter   string `json:"jitter"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		interval, parseErr := time.ParseDuration(body.Interval)
+		jitter := time.Duration(0)
+		if parseErr == nil && body.Jitter != "" {
+			jitter, parseErr = time.ParseDuration(body.Jitter)
+		}
+		if parseErr != nil {
+			http.Error(w, "Invalid duration: "+parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := proxyManager.SetInterval(interval, jitter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxyManager.RotationState())
+}
+
 func handlePorts(w http.ResponseWriter, r *http.Request, proxyManager *ProxyManager) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -141,75 +295,153 @@ func handlePorts(w http.ResponseWriter, r *http.Request, proxyManager *ProxyMana
 		return
 	}
 
-	proxyManager.UpdatePorts(ports)
-	w.WriteHeader(http.StatusOK)
+	if err := proxyManager.UpdatePorts(ports); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxyManager.ListProxies())
 }
 
-func (pm *ProxyManager) ListProxies() []string {
+// ListProxies returns the proxy instances owned by the manager.
+func (pm *ProxyManager) ListProxies() []ProxyInstance {
 	if pm == nil {
 		logError("ProxyManager is nil")
 		return nil
 	}
-
-	var proxyList []string
-	for _, proxy := range pm.proxies {
-		proxyList = append(proxyList, proxy.String())
-	}
-	return proxyList
+	return pm.registry.List()
 }
 
-func (pm *ProxyManager) AddProxy(id, address, backendURL string) {
+// AddProxy starts a new proxy listener and adds it to the rotation.
+func (pm *ProxyManager) AddProxy(id, address, backendURL string) (*ProxyInstance, error) {
 	newBackend, err := url.Parse(backendURL)
 	if err != nil {
-		logError("Failed to parse backend URL: %v", err)
-		return
+		return nil, fmt.Errorf("invalid backend URL: %v", err)
 	}
 
-	publicProxyURL := fmt.Sprintf("https://%s%s", getServerIPAddress(), address)
-	newPublicProxy, err := url.Parse(publicProxyURL)
+	instance, err := pm.registry.Start(id, address, backendURL)
 	if err != nil {
-		logError("Failed to parse public proxy URL: %v", err)
-		return
+		logError("Failed to add proxy %s: %v", id, err)
+		return nil, err
+	}
+	newPublicProxy, err := url.Parse(instance.URL)
+	if err != nil {
+		return nil, err
 	}
 
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	for _, proxy := range pm.proxies {
-		if proxy.String() == newPublicProxy.String() {
-			logWarning("Proxy %s already exists; skipping addition", newPublicProxy.String())
-			return
-		}
-	}
 	pm.proxies = append(pm.proxies, newPublicProxy)
-	logInfo("Added new proxy: %s (%s -> %s)", id, publicProxyURL, newBackend)
+	pm.mu.Unlock()
+	logInfo("Added new proxy: %s (%s -> %s)", id, instance.URL, newBackend)
+	return instance, nil
 }
 
-func (pm *ProxyManager) RemoveProxy(proxyID string) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+// proxyInUseError is returned when a proxy cannot be removed because it is
+// active and no other proxy can take over on this node.
+type proxyInUseError struct {
+	reason string
+}
+
+func (e proxyInUseError) Error() string {
+	return e.reason
+}
+
+// RemoveProxy takes a proxy out of the rotation and shuts its listener down
+// gracefully in the background. Removing the active proxy switches to
+// another one even when rotation is paused, and removing the pinned proxy
+// unpins rotation.
+func (pm *ProxyManager) RemoveProxy(proxyID string) (ProxyInstance, error) {
+	instance, ok := pm.registry.Get(proxyID)
+	if !ok {
+		logWarning("Proxy %s not found; nothing removed", proxyID)
+		return ProxyInstance{}, fmt.Errorf("proxy %s not found", proxyID)
+	}
 
+	pm.mu.Lock()
 	for i, proxy := range pm.proxies {
-		if strings.Contains(proxy.String(), proxyID) {
-			pm.proxies = append(pm.proxies[:i], pm.proxies[i+1:]...)
-			logInfo("Proxy %s removed successfully", proxyID)
-			return
+		if proxy.String() != instance.URL {
+			continue
+		}
+		var replacement *url.URL
+		if sameProxy(proxy, pm.currentProxy) {
+			// Followers serve the proxy chosen by the leader and cannot
+			// switch on their own.
+			if pm.isFollower() {
+				pm.mu.Unlock()
+				return ProxyInstance{}, proxyInUseError{fmt.Sprintf("proxy %s is active and rotation is led by another node", proxyID)}
+			}
+			candidates := excludeProxy(pm.rotationCandidates(), proxy)
+			if len(candidates) == 0 {
+				pm.mu.Unlock()
+				return ProxyInstance{}, proxyInUseError{fmt.Sprintf("proxy %s is active and no other proxy can replace it", proxyID)}
+			}
+			if replacement = pm.strategy.Next(candidates, pm.currentProxy); replacement == nil {
+				replacement = candidates[0]
+			}
+		}
+
+		pm.proxies = append(pm.proxies[:i], pm.proxies[i+1:]...)
+		if sameProxy(proxy, pm.pinned) {
+			pm.pinned = nil
+			logInfo("Pinned proxy %s removed, rotation unpinned", proxyID)
+			pm.shareControl()
 		}
+		if replacement != nil {
+			pm.setCurrentProxy(replacement, "removed")
+		}
+		break
 	}
-	logWarning("Proxy %s not found; nothing removed", proxyID)
+	pm.mu.Unlock()
+
+	go pm.registry.Stop(proxyID)
+
+	instance.State = ProxyStopping
+	logInfo("Proxy %s removed successfully", proxyID)
+	return instance, nil
 }
 
-func (pm *ProxyManager) UpdatePorts(ports []string) {
-	if len(ports) != len(pm.proxies) {
+// UpdatePorts rebinds every proxy, in creation order, to the given ports.
+func (pm *ProxyManager) UpdatePorts(ports []string) error {
+	instances := pm.registry.List()
+	if len(ports) != len(instances) {
 		logWarning("Number of ports does not match number of proxies")
-		return
+		return fmt.Errorf("expected %d ports, got %d", len(instances), len(ports))
 	}
 
-	for i, proxy := range pm.proxies {
-		host := strings.Split(proxy.Host, ":")[0]
-		pm.proxies[i].Host = fmt.Sprintf("%s:%s", host, ports[i])
+	for i, instance := range instances {
+		oldURL, newURL, err := pm.registry.Rebind(instance.ID, ":"+strings.TrimPrefix(ports[i], ":"))
+		if err != nil {
+			logError("Failed to rebind proxy %s: %v", instance.ID, err)
+			return err
+		}
+		pm.replaceProxyURL(oldURL, newURL)
 	}
 
 	logInfo("Updated proxy ports: %v", ports)
+	return nil
+}
+
+// replaceProxyURL swaps a rebound proxy in the rotation.
+func (pm *ProxyManager) replaceProxyURL(oldURL, newURL string) {
+	if oldURL == newURL {
+		return
+	}
+	parsed, err := url.Parse(newURL)
+	if err != nil {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for i, proxy := range pm.proxies {
+		if proxy.String() == oldURL {
+			pm.proxies[i] = parsed
+		}
+	}
+	if pm.currentProxy != nil && pm.currentProxy.String() == oldURL {
+		pm.currentProxy = parsed
+		pm.UpdateActiveProxy(parsed, pm.epoch)
+	}
 }
 
 // handleACLs manages ACL rules.
@@ -229,12 +461,57 @@ func handleACLs(w http.ResponseWriter, r *http.Request, proxyManager *ProxyManag
 	}
 }
 
-// ReloadACLConfig apply ACL rules to all proxies.
-func ReloadACLConfig() {
+// errACLRuleNotFound is returned when an API change targets a missing rule.
+var errACLRuleNotFound = errors.New("ACL rule not found")
+
+// aclValidationError is returned when a change leaves rules that do not
+// compile.
+type aclValidationError struct {
+	err error
+}
+
+func (e aclValidationError) Error() string {
+	return "invalid ACL: " + e.err.Error()
+}
+
+// updateACL applies change to a copy of the rules, compiles the result and
+// swaps it in, then records it as a new version, persists and publishes it.
+// The previous rules are restored if that fails, so the running ACL never
+// differs from the persisted one.
+func updateACL(author, reason string, change func(config *ACLConfig) error) error {
 	aclMutex.Lock()
 	defer aclMutex.Unlock()
 
-	logInfo("Reloaded global ACL rules.")
+	previous := aclConfig.GetRules()
+	draft := &ACLConfig{Rules: previous}
+	if err := change(draft); err != nil {
+		return err
+	}
+	if err := aclConfig.SetRules(draft.Rules); err != nil {
+		return aclValidationError{err}
+	}
+	if aclSync == nil {
+		return nil
+	}
+	if err := aclSync.Commit(draft.Rules, author, reason); err != nil {
+		aclConfig.SetRules(previous)
+		return err
+	}
+	return nil
+}
+
+// writeACLError reports a failed ACL change.
+func writeACLError(w http.ResponseWriter, err error) {
+	if err == errACLRuleNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if _, ok := err.(aclValidationError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logError("Failed to persist ACL change: %v", err)
+	http.Error(w, "Failed to persist ACL change", http.StatusInternalServerError)
 }
 
 // getACLHandler return ACL rules.
@@ -273,9 +550,15 @@ func addACLHandler(w http.ResponseWriter, r *http.Request, proxyManager *ProxyMa
 		priority = 0
 	}
 
-	aclConfig.AddRuleWithPriority(requestData.Rule, priority)
-	ReloadACL()
-	ApplyACLToProxies(proxyManager)
+	err := updateACL(aclAuthor(r), "add rule "+requestData.Rule.ID(), func(config *ACLConfig) error {
+		config.AddRuleWithPriority(requestData.Rule, priority)
+		config.EnsureAllowAllLast()
+		return nil
+	})
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "ACL rule added successfully"})
@@ -295,8 +578,20 @@ func modifyACLHandler(w http.ResponseWriter, r *http.Request, proxyManager *Prox
 		return
 	}
 
-	aclConfig.UpdateRule(updatedRule)
-	ReloadProxiesWithACLConfig(proxyManager, aclConfig)
+	if updatedRule.ID() == "" {
+		updatedRule.Name = ruleName
+	}
+
+	err := updateACL(aclAuthor(r), "update rule "+ruleName, func(config *ACLConfig) error {
+		if !config.UpdateRule(ruleName, updatedRule) {
+			return errACLRuleNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "ACL rule updated successfully"})
@@ -310,8 +605,16 @@ func deleteACLHandler(w http.ResponseWriter, r *http.Request, proxyManager *Prox
 		return
 	}
 
-	aclConfig.RemoveRule(ruleName)
-	ReloadProxiesWithACLConfig(proxyManager, aclConfig)
+	err := updateACL(aclAuthor(r), "delete rule "+ruleName, func(config *ACLConfig) error {
+		if !config.RemoveRule(ruleName) {
+			return errACLRuleNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "ACL rule deleted successfully"})
@@ -327,6 +630,12 @@ func normalizeACLRules(rules []ACLRule) ([]map[string]interface{}, error) {
 			"action":    rule.Action,
 			"options":   rule.Options,
 		}
+		if rule.ACL != "" {
+			normalizedRule["acl"] = rule.ACL
+		}
+		if rule.If != "" {
+			normalizedRule["if"] = rule.If
+		}
 		normalizedRules = append(normalizedRules, normalizedRule)
 	}
 	return normalizedRules, nil
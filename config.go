@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configVersion is the only configuration file format supported.
+const configVersion = 1
+
+// Config is the versioned configuration file. Every setting mirrors the
+// command-line flag named in its flag tag, and flags given on the command
+// line override the file. Durations are strings such as "10s".
+type Config struct {
+	Version     int               `yaml:"version"`
+	Listen      ListenConfig      `yaml:"listen"`
+	TLS         TLSFileConfig     `yaml:"tls"`
+	Backend     *string           `yaml:"backend" flag:"web-server"`
+	API         APIConfig         `yaml:"api"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Proxies     ProxiesConfig     `yaml:"proxies"`
+	Rotation    RotationFile      `yaml:"rotation"`
+	Redis       RedisFileConfig   `yaml:"redis"`
+	State       StateConfig       `yaml:"state"`
+	Detection   DetectionConfig   `yaml:"detection"`
+	Sessions    SessionsConfig    `yaml:"sessions"`
+	Queue       QueueConfig       `yaml:"queue"`
+	ACL         ACLFileConfig     `yaml:"acl"`
+	HeaderRules HeaderRulesSource `yaml:"header_rules"`
+	Reload      ReloadConfig      `yaml:"reload"`
+}
+
+type ListenConfig struct {
+	Address *string `yaml:"address" flag:"listen"`
+	IP      *string `yaml:"ip" flag:"ip"`
+	Domain  *string `yaml:"domain" flag:"d"`
+}
+
+type TLSFileConfig struct {
+	Cert            *string `yaml:"cert" flag:"crt"`
+	Key             *string `yaml:"key" flag:"key"`
+	InsecureBackend *bool   `yaml:"insecure_backend" flag:"unsecure-cert"`
+}
+
+type APIConfig struct {
+	Enabled *bool `yaml:"enabled" flag:"api"`
+}
+
+type LoggingConfig struct {
+	Verbose *bool `yaml:"verbose" flag:"v"`
+}
+
+type ProxiesConfig struct {
+	Count        *int    `yaml:"count" flag:"proxy-count"`
+	Ports        []int   `yaml:"ports" flag:"proxy-ports"`
+	PortRange    *string `yaml:"port_range" flag:"port-range" check:"port-range"`
+	DrainTimeout *string `yaml:"drain_timeout" flag:"drain-timeout" check:"duration"`
+	MaxRequests  *int    `yaml:"max_requests" flag:"max-requests"`
+}
+
+type RotationFile struct {
+	Strategy             *string        `yaml:"strategy" flag:"rotation-strategy" check:"strategy"`
+	Interval             *string        `yaml:"interval" flag:"rotation-interval" check:"duration"`
+	Jitter               *string        `yaml:"jitter" flag:"rotation-jitter" check:"duration"`
+	Weights              map[string]int `yaml:"weights" flag:"rotation-weights" check:"weights"`
+	Grace                *string        `yaml:"grace" flag:"rotation-grace" check:"duration"`
+	GraceCount           *int           `yaml:"grace_count" flag:"rotation-grace-count"`
+	HistoryMax           *int64         `yaml:"history_max" flag:"rotation-history-max"`
+	ActiveProxyReconcile *string        `yaml:"active_proxy_reconcile" flag:"active-proxy-reconcile" check:"duration"`
+	Handoff              HandoffFile    `yaml:"handoff"`
+	Leader               LeaderFile     `yaml:"leader"`
+	Health               HealthFile     `yaml:"health"`
+	Triggers             TriggersFile   `yaml:"triggers"`
+}
+
+type HandoffFile struct {
+	RulesFile *string `yaml:"rules_file" flag:"handoff-rules"`
+	Mode      *string `yaml:"mode" flag:"handoff-mode" check:"handoff-mode"`
+	MaxHops   *int    `yaml:"max_hops" flag:"handoff-max-hops"`
+}
+
+type LeaderFile struct {
+	Enabled *bool   `yaml:"enabled" flag:"leader-election"`
+	Lease   *string `yaml:"lease" flag:"leader-lease" check:"duration"`
+	NodeID  *string `yaml:"node_id" flag:"node-id"`
+}
+
+type HealthFile struct {
+	Interval *string `yaml:"interval" flag:"health-interval" check:"duration"`
+	Timeout  *string `yaml:"timeout" flag:"health-timeout" check:"duration"`
+	Rise     *int    `yaml:"rise" flag:"health-rise"`
+	Fall     *int    `yaml:"fall" flag:"health-fall"`
+	Fallback *string `yaml:"fallback" flag:"health-fallback" check:"health-fallback"`
+}
+
+type TriggersFile struct {
+	Suspicion *int     `yaml:"suspicion" flag:"trigger-suspicion"`
+	Malicious *bool    `yaml:"malicious" flag:"trigger-malicious"`
+	PortScan  *bool    `yaml:"port_scan" flag:"trigger-port-scan"`
+	ACLRules  []string `yaml:"acl_rules" flag:"trigger-acl-rules"`
+	Cooldown  *string  `yaml:"cooldown" flag:"trigger-cooldown" check:"duration"`
+}
+
+type RedisFileConfig struct {
+	Addrs          []string          `yaml:"addrs" flag:"redis-addr"`
+	Password       *string           `yaml:"password" flag:"redis-password"`
+	DB             *int              `yaml:"db" flag:"redis-db"`
+	TLS            *bool             `yaml:"tls" flag:"redis-tls"`
+	TLSInsecure    *bool             `yaml:"tls_insecure" flag:"redis-tls-insecure"`
+	TLSServerName  *string           `yaml:"tls_server_name" flag:"redis-tls-server-name"`
+	SentinelMaster *string           `yaml:"sentinel_master" flag:"redis-sentinel-master"`
+	Cluster        *bool             `yaml:"cluster" flag:"redis-cluster"`
+	Prefix         *string           `yaml:"prefix" flag:"redis-prefix"`
+	CheckInterval  *string           `yaml:"check_interval" flag:"redis-check-interval" check:"duration"`
+	FailPolicy     map[string]string `yaml:"fail_policy" flag:"redis-fail-policy" check:"fail-policy"`
+}
+
+type StateConfig struct {
+	Store *string `yaml:"store" flag:"state-store" check:"state-store"`
+	File  *string `yaml:"file" flag:"state-file"`
+}
+
+type DetectionConfig struct {
+	Enabled      *bool      `yaml:"enabled" flag:"enable-detection"`
+	URL          *string    `yaml:"url" flag:"detection-url"`
+	MaxSuspicion *int       `yaml:"max_suspicion" flag:"max-suspicion"`
+	Probes       ProbesFile `yaml:"probes"`
+}
+
+type ProbesFile struct {
+	Policy      *string `yaml:"policy" flag:"probe-policy" check:"probe-policy"`
+	Suspicion   *int    `yaml:"suspicion" flag:"probe-suspicion"`
+	BanDuration *string `yaml:"ban_duration" flag:"probe-ban-duration" check:"duration"`
+	DecoyURL    *string `yaml:"decoy_url" flag:"probe-decoy-url"`
+}
+
+type SessionsConfig struct {
+	JWTTTL           *string    `yaml:"jwt_ttl" flag:"jwt-ttl" check:"duration"`
+	Targeting        *bool      `yaml:"targeting" flag:"session-targeting"`
+	RotationInterval *string    `yaml:"rotation_interval" flag:"session-rotation-interval" check:"duration"`
+	Tokens           TokensFile `yaml:"tokens"`
+}
+
+type TokensFile struct {
+	Policy    *string `yaml:"policy" flag:"token-policy" check:"token-policy"`
+	Secret    *string `yaml:"secret" flag:"token-secret"`
+	TTL       *string `yaml:"ttl" flag:"token-ttl" check:"duration"`
+	EpochLag  *uint64 `yaml:"epoch_lag" flag:"token-epoch-lag"`
+	MaxAge    *string `yaml:"max_age" flag:"token-max-age" check:"duration"`
+	Tarpit    *string `yaml:"tarpit" flag:"token-tarpit" check:"duration"`
+	TarpitMax *int    `yaml:"tarpit_max" flag:"token-tarpit-max"`
+}
+
+type QueueConfig struct {
+	Enabled *bool `yaml:"enabled" flag:"queue-system"`
+}
+
+// ACLFileConfig points to an ACL file or defines the rules inline.
+type ACLFileConfig struct {
+	File    *string   `yaml:"file" flag:"acl-file"`
+	Persist *string   `yaml:"persist" flag:"acl-persist" check:"acl-persist"`
+	History *int64    `yaml:"history" flag:"acl-history"`
+	Rules   []ACLRule `yaml:"rules"`
+}
+
+// HeaderRulesSource points to a header rules file or defines them inline.
+type HeaderRulesSource struct {
+	File  *string      `yaml:"file" flag:"header-rules"`
+	Rules []HeaderRule `yaml:"rules"`
+}
+
+// ReloadConfig controls how often rule files are checked for changes.
+type ReloadConfig struct {
+	WatchInterval *string `yaml:"watch_interval" flag:"config-watch-interval" check:"duration"`
+}
+
+// envVarPattern matches ${NAME} and ${NAME:-default}.
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv substitutes environment variables line by line so errors can
+// name the line. Comment lines are left untouched.
+func expandEnv(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if !strings.HasPrefix(strings.TrimSpace(text), "#") {
+			var missing string
+			text = envVarPattern.ReplaceAllStringFunc(text, func(match string) string {
+				groups := envVarPattern.FindStringSubmatch(match)
+				if value, ok := os.LookupEnv(groups[1]); ok {
+					return value
+				}
+				if groups[2] != "" {
+					return groups[3]
+				}
+				missing = groups[1]
+				return match
+			})
+			if missing != "" {
+				return nil, fmt.Errorf("line %d: environment variable %s is not set", line, missing)
+			}
+		}
+		out.WriteString(text)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), scanner.Err()
+}
+
+// LoadConfig reads a configuration file strictly: unknown fields, type
+// mismatches and unsupported versions are errors reported with their line.
+// The expanded file content is returned to locate later errors.
+func LoadConfig(path string) (*Config, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = expandEnv(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if config.Version != configVersion {
+		if config.Version == 0 {
+			return nil, nil, fmt.Errorf("%s: missing version, expected version: %d", path, configVersion)
+		}
+		return nil, nil, fmt.Errorf("%s: line %d: unsupported version %d, expected %d", path, yamlLine(data, []string{"version"}), config.Version, configVersion)
+	}
+	if config.ACL.File != nil && config.ACL.Rules != nil {
+		return nil, nil, fmt.Errorf("%s: line %d: acl.file and acl.rules are mutually exclusive", path, yamlLine(data, []string{"acl", "rules"}))
+	}
+	if config.HeaderRules.File != nil && config.HeaderRules.Rules != nil {
+		return nil, nil, fmt.Errorf("%s: line %d: header_rules.file and header_rules.rules are mutually exclusive", path, yamlLine(data, []string{"header_rules", "rules"}))
+	}
+	if err := checkConfigValues(reflect.ValueOf(&config).Elem(), nil, data); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &config, data, nil
+}
+
+// configChecks validate the settings tagged with their name. Their flags
+// accept any string, so without them an invalid strategy, mode, range or
+// duration would only fail at startup, without its line.
+var configChecks = map[string]func(value string) error{
+	"duration": func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("negative duration")
+		}
+		return nil
+	},
+	"strategy": func(value string) error {
+		_, err := NewRotationStrategy(value, nil)
+		return err
+	},
+	"weights": func(value string) error {
+		_, err := parseRotationWeights(value)
+		return err
+	},
+	"port-range": func(value string) error {
+		_, _, err := parsePortRange(value)
+		return err
+	},
+	"handoff-mode":    configOneOf(HandoffAuto, HandoffFound, HandoffTemporary, HandoffPermanent, HandoffForward),
+	"health-fallback": configOneOf("keep", "any"),
+	"probe-policy":    configOneOf("off", "log", "ban", "decoy"),
+	"token-policy":    configOneOf("off", "reject", "tarpit"),
+	"state-store":     configOneOf("redis", "memory", "file"),
+	"fail-policy": func(value string) error {
+		_, err := parseDegradedPolicy(value)
+		return err
+	},
+	"acl-persist": configOneOf(ACLPersistNone, ACLPersistFile, ACLPersistStore),
+}
+
+func configOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, allowed := range values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(values, ", "))
+	}
+}
+
+// checkConfigValues runs the check named in the check tag of every setting
+// defined in the file.
+func checkConfigValues(v reflect.Value, path []string, data []byte) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		fieldPath := append(path[:len(path):len(path)], strings.Split(field.Tag.Get("yaml"), ",")[0])
+
+		if field.Tag.Get("flag") == "" && value.Kind() == reflect.Struct {
+			if err := checkConfigValues(value, fieldPath, data); err != nil {
+				return err
+			}
+			continue
+		}
+		check, ok := configChecks[field.Tag.Get("check")]
+		if !ok || value.IsNil() {
+			continue
+		}
+		formatted := formatConfigValue(value)
+		if err := check(formatted); err != nil {
+			return fmt.Errorf("line %d: %s: invalid value %q: %v", yamlLine(data, fieldPath), strings.Join(fieldPath, "."), formatted, err)
+		}
+	}
+	return nil
+}
+
+// ApplyFlags sets every flag defined in the file, except those given on the
+// command line. Values not checked by LoadConfig are validated by the flags
+// themselves; errors carry the line of the offending setting.
+func (config *Config) ApplyFlags(data []byte) error {
+	return applyConfigFlags(reflect.ValueOf(config).Elem(), nil, data)
+}
+
+func applyConfigFlags(v reflect.Value, path []string, data []byte) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		fieldPath := append(path[:len(path):len(path)], strings.Split(field.Tag.Get("yaml"), ",")[0])
+
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			if value.Kind() == reflect.Struct {
+				if err := applyConfigFlags(value, fieldPath, data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if value.IsNil() || isFlagSet(flagName) {
+			continue
+		}
+		formatted := formatConfigValue(value)
+		if err := flag.Set(flagName, formatted); err != nil {
+			return fmt.Errorf("line %d: %s: invalid value %q: %v", yamlLine(data, fieldPath), strings.Join(fieldPath, "."), formatted, err)
+		}
+	}
+	return nil
+}
+
+// formatConfigValue renders a setting the way its flag expects it: lists
+// are comma-separated and maps become sorted key=value lists.
+func formatConfigValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Ptr:
+		return formatConfigValue(v.Elem())
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatConfigValue(v.Index(i))
+		}
+		return strings.Join(items, ",")
+	case reflect.Map:
+		items := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			items = append(items, formatConfigValue(key)+"="+formatConfigValue(v.MapIndex(key)))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return v.String()
+}
+
+// yamlKeyPattern matches a block mapping key, possibly as a list item.
+var yamlKeyPattern = regexp.MustCompile(`^(\s*)(- )?([A-Za-z0-9_]+)\s*:`)
+
+// yamlLine returns the line where the mapping key at path is defined, or 0
+// when it cannot be found.
+func yamlLine(data []byte, path []string) int {
+	type key struct {
+		indent int
+		name   string
+	}
+	var stack []key
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		match := yamlKeyPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		indent := len(match[1]) + len(match[2])
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, key{indent, match[3]})
+		if len(stack) != len(path) {
+			continue
+		}
+		found := true
+		for i := range path {
+			if stack[i].name != path[i] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return line
+		}
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "morphproxy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigSample(t *testing.T) {
+	if _, _, err := LoadConfig("morphproxy.yaml"); err != nil {
+		t.Fatalf("LoadConfig(morphproxy.yaml): %v", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name:    "missing version",
+			content: "rotation:\n  strategy: random\n",
+			err:     "missing version",
+		},
+		{
+			name:    "unsupported version",
+			content: "# comment\nversion: 2\n",
+			err:     "line 2: unsupported version 2",
+		},
+		{
+			name:    "unknown field",
+			content: "version: 1\nrotation:\n  stratgy: random\n",
+			err:     "line 3",
+		},
+		{
+			name:    "type mismatch",
+			content: "version: 1\nproxies:\n  count: many\n",
+			err:     "line 3",
+		},
+		{
+			name:    "unset environment variable",
+			content: "version: 1\nbackend: ${MORPHPROXY_TEST_UNSET}\n",
+			err:     "line 2: environment variable MORPHPROXY_TEST_UNSET is not set",
+		},
+		{
+			name:    "invalid strategy",
+			content: "version: 1\nrotation:\n  interval: 10s\n  strategy: shuffle\n",
+			err:     `line 4: rotation.strategy: invalid value "shuffle"`,
+		},
+		{
+			name:    "invalid wrapped strategy",
+			content: "version: 1\nrotation:\n  strategy: health-aware:shuffle\n",
+			err:     "line 3: rotation.strategy",
+		},
+		{
+			name:    "invalid handoff mode",
+			content: "version: 1\nrotation:\n  handoff:\n    max_hops: 3\n    mode: bounce\n",
+			err:     `line 5: rotation.handoff.mode: invalid value "bounce"`,
+		},
+		{
+			name:    "invalid duration",
+			content: "version: 1\nrotation:\n  strategy: random\n  interval: 10 seconds\n",
+			err:     `line 4: rotation.interval: invalid value "10 seconds"`,
+		},
+		{
+			name:    "negative duration",
+			content: "version: 1\nrotation:\n  leader:\n    lease: -5s\n",
+			err:     "line 4: rotation.leader.lease",
+		},
+		{
+			name:    "invalid port range",
+			content: "version: 1\nproxies:\n  count: 2\n  port_range: 3000-2000\n",
+			err:     `line 4: proxies.port_range: invalid value "3000-2000"`,
+		},
+		{
+			name:    "invalid weights",
+			content: "version: 1\nrotation:\n  weights:\n    \"8081\": -1\n",
+			err:     "line 3: rotation.weights",
+		},
+		{
+			name:    "invalid health fallback",
+			content: "version: 1\nrotation:\n  health:\n    fallback: random\n",
+			err:     "line 4: rotation.health.fallback",
+		},
+		{
+			name:    "invalid probe policy",
+			content: "version: 1\ndetection:\n  probes:\n    policy: block\n",
+			err:     "line 4: detection.probes.policy",
+		},
+		{
+			name:    "invalid state store",
+			content: "version: 1\nstate:\n  store: etcd\n",
+			err:     "line 3: state.store",
+		},
+		{
+			name:    "invalid fail policy",
+			content: "version: 1\nredis:\n  fail_policy:\n    blacklist: maybe\n",
+			err:     "line 3: redis.fail_policy",
+		},
+		{
+			name:    "acl file and rules",
+			content: "version: 1\nacl:\n  file: acl.yaml\n  rules: []\n",
+			err:     "line 4: acl.file and acl.rules are mutually exclusive",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := LoadConfig(writeConfig(t, c.content))
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("LoadConfig error = %v, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidValues(t *testing.T) {
+	path := writeConfig(t, `version: 1
+proxies:
+  port_range: "20000-29999"
+rotation:
+  strategy: health-aware:weighted
+  weights:
+    "8081": 3
+  interval: 1m
+  handoff:
+    mode: temporary
+  health:
+    fallback: any
+detection:
+  probes:
+    policy: "off"
+state:
+  store: file
+redis:
+  fail_policy:
+    blacklist: closed
+sessions:
+  tokens:
+    policy: tarpit
+    tarpit: 0s
+`)
+	if _, _, err := LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+}
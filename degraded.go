@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies applied by a subsystem when Redis is unreachable.
+const (
+	FailLocal  = "local"  // use the in-memory state of this instance
+	FailOpen   = "open"   // allow the request
+	FailClosed = "closed" // deny the request
+)
+
+// errRedisUnavailable is returned instead of calling Redis while it is down.
+var errRedisUnavailable = errors.New("redis unavailable")
+
+var (
+	redisUpGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "redis_up",
+			Help: "Whether Redis is reachable (1) or MorphProxy runs in degraded mode (0)",
+		},
+	)
+	redisOutagesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "redis_outages_total",
+			Help: "Total number of times Redis became unreachable",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(redisUpGauge, redisOutagesTotal)
+}
+
+// DegradedPolicy selects the behaviour of each Redis-backed subsystem while
+// Redis is unreachable.
+type DegradedPolicy struct {
+	Blacklist string `json:"blacklist"`  // session blacklist checks
+	RateLimit string `json:"rate_limit"` // session creation rate limit
+	Bans      string `json:"bans"`       // IP bans
+}
+
+var degradedPolicy = DegradedPolicy{Blacklist: FailLocal, RateLimit: FailLocal, Bans: FailLocal}
+
+// parseDegradedPolicy parses a subsystem=policy list such as
+// "blacklist=closed,rate-limit=open". Omitted subsystems use local state.
+func parseDegradedPolicy(s string) (DegradedPolicy, error) {
+	policy := DegradedPolicy{Blacklist: FailLocal, RateLimit: FailLocal, Bans: FailLocal}
+	if s == "" {
+		return policy, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return policy, fmt.Errorf("invalid policy %q, expected subsystem=policy", pair)
+		}
+		switch parts[1] {
+		case FailLocal, FailOpen, FailClosed:
+		default:
+			return policy, fmt.Errorf("invalid policy %q for %s (local, open, closed)", parts[1], parts[0])
+		}
+		switch parts[0] {
+		case "blacklist":
+			policy.Blacklist = parts[1]
+		case "rate-limit":
+			policy.RateLimit = parts[1]
+		case "bans":
+			policy.Bans = parts[1]
+		default:
+			return policy, fmt.Errorf("unknown subsystem %q (blacklist, rate-limit, bans)", parts[0])
+		}
+	}
+	return policy, nil
+}
+
+// localFallback holds the state used while Redis is unreachable.
+var localFallback = newLocalState()
+
+type localEntry struct {
+	value   int64
+	expires time.Time // zero for no expiry
+	dirty   bool      // written while Redis was unreachable
+}
+
+// localState is a small in-memory key/value store with expiry. Keys are the
+// state store keys so entries can be written back on recovery.
+type localState struct {
+	mu      sync.Mutex
+	entries map[string]*localEntry
+}
+
+func newLocalState() *localState {
+	return &localState{entries: make(map[string]*localEntry)}
+}
+
+// entry returns the live entry for key. Must be called with ls.mu held.
+func (ls *localState) entry(key string) (*localEntry, bool) {
+	entry, ok := ls.entries[key]
+	if ok && !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(ls.entries, key)
+		return nil, false
+	}
+	return entry, ok
+}
+
+// Set stores value for ttl (0 for no expiry). Dirty entries are written back
+// to Redis when it recovers.
+func (ls *localState) Set(key string, value int64, ttl time.Duration, dirty bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	entry := &localEntry{value: value, dirty: dirty}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	ls.entries[key] = entry
+}
+
+// Get returns the value of key and whether it exists.
+func (ls *localState) Get(key string) (int64, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	entry, ok := ls.entry(key)
+	if !ok {
+		return 0, false
+	}
+	return entry.value, true
+}
+
+// IncrBy adds delta to key. The ttl only applies when the key is created.
+func (ls *localState) IncrBy(key string, delta int64, ttl time.Duration) int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	entry, ok := ls.entry(key)
+	if !ok {
+		entry = &localEntry{}
+		if ttl > 0 {
+			entry.expires = time.Now().Add(ttl)
+		}
+		ls.entries[key] = entry
+	}
+	entry.value += delta
+	return entry.value
+}
+
+// DecayPrefix decrements every positive counter whose key has the prefix.
+func (ls *localState) DecayPrefix(prefix string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for key, entry := range ls.entries {
+		if strings.HasPrefix(key, prefix) && entry.value > 0 {
+			entry.value--
+		}
+	}
+}
+
+// sweep drops expired entries.
+func (ls *localState) sweep() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for key := range ls.entries {
+		ls.entry(key)
+	}
+}
+
+// replay writes the dirty entries back to the store with their remaining TTL.
+func (ls *localState) replay(store StateStore) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	replayed := 0
+	for key, entry := range ls.entries {
+		if !entry.dirty {
+			continue
+		}
+		ttl := time.Duration(0)
+		if !entry.expires.IsZero() {
+			if ttl = time.Until(entry.expires); ttl <= 0 {
+				delete(ls.entries, key)
+				continue
+			}
+		}
+		if err := store.Set(key, strconv.FormatInt(entry.value, 10), ttl); err != nil {
+			logError("Failed to write back %s to Redis: %v", key, err)
+			continue
+		}
+		entry.dirty = false
+		replayed++
+	}
+	if replayed > 0 {
+		logInfo("Wrote %d entries recorded in degraded mode back to Redis", replayed)
+	}
+}
+
+// redisMonitor tracks the reachability of the shared Redis client.
+var redisMonitor *RedisMonitor
+
+// RedisStatus is the Redis health reported by the API.
+type RedisStatus struct {
+	Up        bool           `json:"up"`
+	LastCheck time.Time      `json:"last_check"`
+	DownSince *time.Time     `json:"down_since,omitempty"`
+	LastError string         `json:"last_error,omitempty"`
+	Policy    DegradedPolicy `json:"policy"`
+}
+
+// RedisMonitor pings Redis periodically and runs the recovery hooks when the
+// connection returns after an outage.
+type RedisMonitor struct {
+	client   redis.UniversalClient
+	interval time.Duration
+
+	mu        sync.RWMutex
+	up        bool
+	lastCheck time.Time
+	downSince time.Time
+	lastError string
+	onRecover []func()
+}
+
+func NewRedisMonitor(client redis.UniversalClient, interval time.Duration) *RedisMonitor {
+	return &RedisMonitor{client: client, interval: interval, up: true}
+}
+
+// OnRecover registers a function called when Redis becomes reachable again.
+func (m *RedisMonitor) OnRecover(hook func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onRecover = append(m.onRecover, hook)
+}
+
+// Start checks Redis once, then on every interval until shutdown.
+func (m *RedisMonitor) Start() {
+	m.check()
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rootCtx.Done():
+				return
+			case <-ticker.C:
+				m.check()
+				localFallback.sweep()
+			}
+		}
+	}()
+}
+
+func (m *RedisMonitor) check() {
+	err := m.client.Ping(ctx).Err()
+
+	m.mu.Lock()
+	wasUp := m.up
+	m.up = err == nil
+	m.lastCheck = time.Now()
+	if err != nil {
+		m.lastError = err.Error()
+		if wasUp {
+			m.downSince = m.lastCheck
+		}
+	} else {
+		m.lastError = ""
+	}
+	hooks := m.onRecover
+	m.mu.Unlock()
+
+	if err != nil {
+		redisUpGauge.Set(0)
+	} else {
+		redisUpGauge.Set(1)
+	}
+	switch {
+	case wasUp && err != nil:
+		redisOutagesTotal.Inc()
+		logError("Redis unreachable, running in degraded mode: %v", err)
+	case !wasUp && err == nil:
+		logSuccess("Redis reachable again, reconciling state")
+		for _, hook := range hooks {
+			hook()
+		}
+	}
+}
+
+// Up reports whether Redis answered the last check.
+func (m *RedisMonitor) Up() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.up
+}
+
+// Status returns the Redis health and the degraded-mode policy.
+func (m *RedisMonitor) Status() RedisStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status := RedisStatus{Up: m.up, LastCheck: m.lastCheck, LastError: m.lastError, Policy: degradedPolicy}
+	if !m.up {
+		downSince := m.downSince
+		status.DownSince = &downSince
+	}
+	return status
+}
+
+// redisUp reports whether Redis is believed reachable. Callers skip Redis
+// and apply the degraded-mode policy when it is not.
+func redisUp() bool {
+	return redisMonitor == nil || redisMonitor.Up()
+}
+
+// degradedDecision applies a fail-open or fail-closed policy; local reports
+// whether the caller must use its in-memory state instead.
+func degradedDecision(policy string) (allow, local bool) {
+	switch policy {
+	case FailOpen:
+		return true, false
+	case FailClosed:
+		return false, false
+	}
+	return false, true
+}
+
+// reconcileAfterOutage publishes the proxy chosen locally during an outage,
+// unless another node leads rotation, and refreshes the active proxy view.
+func (pm *ProxyManager) reconcileAfterOutage() {
+	pm.mu.Lock()
+	follower := pm.isFollower()
+	current, epoch := pm.currentProxy, pm.epoch
+	pm.mu.Unlock()
+	if follower {
+		pm.loadEpoch()
+	} else if current != nil {
+		pm.UpdateActiveProxy(current, epoch)
+	}
+	activeProxyView.reconcile(stateStore)
+}
+
+// handleRedisStatus returns the Redis health.
+func handleRedisStatus(w http.ResponseWriter, r *http.Request) {
+	logAPIRequest(r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if redisMonitor == nil {
+		http.Error(w, "Redis monitoring disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redisMonitor.Status())
+}
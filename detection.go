@@ -6,57 +6,81 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
+// detectionURL is the URL of the attack detection service.
+var detectionURL = "http://localhost:3000"
+
 // NewSuspiciousRating initializes a SuspiciousRating instance
-func NewSuspiciousRating(redisAddr string, maxSuspicion int) *SuspiciousRating {
-	client := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-	sr := &SuspiciousRating{client: client, maxSuspicion: maxSuspicion}
+func NewSuspiciousRating(store StateStore, maxSuspicion int) *SuspiciousRating {
+	sr := &SuspiciousRating{store: store, maxSuspicion: maxSuspicion}
 	go sr.startDecay()
 	return sr
 }
 
+// suspicionKey returns the key holding the suspicion rating of an IP.
+func suspicionKey(ip string) string {
+	return "suspicion:" + ip
+}
+
 // UpdateRating updates the suspicion rating for a given IP
 func (sr *SuspiciousRating) UpdateRating(ip string, delta int) {
-	sr.client.IncrBy(ctx, ip, int64(delta))
+	if !redisUp() {
+		rating := localFallback.IncrBy(suspicionKey(ip), int64(delta), 0)
+		rotationTriggers.OnSuspicion(ip, int(rating))
+		return
+	}
+	rating, err := sr.store.IncrBy(suspicionKey(ip), int64(delta), 0)
+	if err != nil {
+		logError("Error updating rating for IP %s: %v", ip, err)
+		rating = localFallback.IncrBy(suspicionKey(ip), int64(delta), 0)
+	}
+	rotationTriggers.OnSuspicion(ip, int(rating))
 }
 
 // GetRating retrieves the suspicion rating for a given IP
 func (sr *SuspiciousRating) GetRating(ip string) int {
-	rating, err := sr.client.Get(ctx, ip).Int()
-	if err == redis.Nil {
-		return 0
-	} else if err != nil {
+	local, _ := localFallback.Get(suspicionKey(ip))
+	if !redisUp() {
+		return int(local)
+	}
+	value, found, err := sr.store.Get(suspicionKey(ip))
+	if err != nil {
 		logError("Error getting rating for IP %s: %v", ip, err)
-		return 0
+		return int(local)
+	} else if !found {
+		return int(local)
 	}
-	return rating
+	rating, _ := strconv.Atoi(value)
+	// Ratings accumulated locally during an outage still count.
+	return rating + int(local)
 }
 
 // startDecay starts the periodic decay of suspicion ratings
 func (sr *SuspiciousRating) startDecay() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
-	for range ticker.C {
-		sr.decayRatings()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+			sr.decayRatings()
+		}
 	}
 }
 
 // decayRatings decrements the suspicion ratings over time
 func (sr *SuspiciousRating) decayRatings() {
-	keys, err := sr.client.Keys(ctx, "*").Result()
-	if err != nil {
-		logError("Error getting keys for decay: %v", err)
+	localFallback.DecayPrefix(suspicionKey(""))
+	if !redisUp() {
 		return
 	}
-	for _, key := range keys {
-		sr.client.DecrBy(ctx, key, 1)
+	if err := sr.store.DecayCounters(suspicionKey("")); err != nil {
+		logError("Error decaying suspicion ratings: %v", err)
 	}
 }
 
@@ -114,8 +138,7 @@ func sendToDetectionService(data map[string]interface{}) (string, error) {
 	}
 
 	// Créer une nouvelle requête HTTP
-	url := "http://localhost:3000" // URL du service Flask
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest(http.MethodPost, detectionURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", err
 	}
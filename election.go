@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	leaderKey               = "rotation_leader"
+	rotationRequestsChannel = "rotation_requests"
+	rotationControlKey      = "rotation_control"
+	rotationControlChannel  = "rotation_control"
+)
+
+var (
+	rotationIsLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rotation_is_leader",
+			Help: "Whether this instance is the rotation leader (1) or a follower (0)",
+		},
+	)
+	rotationLeader = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rotation_leader",
+			Help: "Current rotation leader as seen by this instance",
+		},
+		[]string{"node_id"},
+	)
+	rotationLeaderChangesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rotation_leader_changes_total",
+			Help: "Total number of times this instance gained or lost leadership",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rotationIsLeader, rotationLeader, rotationLeaderChangesTotal)
+}
+
+// renewLeaseScript extends the lease only if this node still holds it.
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLeaseScript deletes the lease only if this node holds it.
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// LeaderElection elects a single rotation leader among the instances sharing
+// a Redis through a lease key. Only the leader rotates and publishes proxy
+// updates; followers apply the updates they receive.
+type LeaderElection struct {
+	client redis.UniversalClient
+	nodeID string
+	lease  time.Duration
+
+	mu      sync.RWMutex
+	leader  bool
+	current string
+	// renewedAt is when the lease was last acquired or renewed; past
+	// renewedAt+lease another node may hold it.
+	renewedAt time.Time
+
+	onElected func()
+}
+
+// LeaderStatus is the election state reported by the API.
+type LeaderStatus struct {
+	NodeID   string `json:"node_id"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+// EnableLeaderElection makes rotation conditional on holding the leader lease.
+func (pm *ProxyManager) EnableLeaderElection(client redis.UniversalClient, lease time.Duration) {
+	election := &LeaderElection{
+		client: client,
+		nodeID: nodeID,
+		lease:  lease,
+		onElected: func() {
+			pm.loadControl()
+			pm.resetTicker()
+		},
+	}
+
+	pm.mu.Lock()
+	pm.election = election
+	pm.mu.Unlock()
+
+	logInfo("Leader election enabled (node: %s, lease: %s)", nodeID, lease)
+	pm.loadEpoch()
+	pm.loadControl()
+	election.campaign()
+	go election.run()
+	go pm.followUpdates(client)
+}
+
+func (le *LeaderElection) run() {
+	ticker := time.NewTicker(le.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+			le.campaign()
+		}
+	}
+}
+
+// campaign renews the lease when leader, or tries to acquire it otherwise.
+func (le *LeaderElection) campaign() {
+	le.mu.RLock()
+	wasLeader := le.leader
+	renewedAt := le.renewedAt
+	le.mu.RUnlock()
+
+	isLeader := false
+	attempt := time.Now()
+	if wasLeader {
+		renewed, err := renewLeaseScript.Run(ctx, le.client, []string{redisKey(leaderKey)}, le.nodeID, le.lease.Milliseconds()).Int()
+		switch {
+		case err == nil:
+			isLeader = renewed == 1
+		case time.Since(renewedAt) < le.lease:
+			// The lease cannot be checked while Redis is unreachable, but
+			// no other node can hold it before it expires.
+			logError("Failed to renew leader lease, keeping leadership until it expires: %v", err)
+			isLeader = true
+			attempt = renewedAt
+		default:
+			logError("Failed to renew leader lease, which has expired: %v", err)
+		}
+	} else {
+		acquired, err := le.client.SetNX(ctx, redisKey(leaderKey), le.nodeID, le.lease).Result()
+		if err != nil {
+			logError("Failed to acquire leader lease: %v", err)
+		}
+		isLeader = err == nil && acquired
+	}
+
+	current, err := le.client.Get(ctx, redisKey(leaderKey)).Result()
+	if err != nil && err != redis.Nil {
+		logError("Failed to read current leader: %v", err)
+	}
+
+	le.mu.Lock()
+	le.leader = isLeader
+	if isLeader {
+		le.renewedAt = attempt
+	}
+	if current != le.current {
+		rotationLeader.DeleteLabelValues(le.current)
+		if current != "" {
+			rotationLeader.WithLabelValues(current).Set(1)
+		}
+		le.current = current
+	}
+	le.mu.Unlock()
+
+	if isLeader {
+		rotationIsLeader.Set(1)
+	} else {
+		rotationIsLeader.Set(0)
+	}
+	if isLeader != wasLeader {
+		rotationLeaderChangesTotal.Inc()
+		if isLeader {
+			logSuccess("Node %s is now the rotation leader", le.nodeID)
+			le.onElected()
+		} else {
+			logWarning("Node %s lost rotation leadership", le.nodeID)
+		}
+	}
+}
+
+// IsLeader reports whether this node currently holds the lease. Leadership
+// ends when the lease expires, even before the next campaign notices.
+func (le *LeaderElection) IsLeader() bool {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	return le.holdsLease()
+}
+
+// holdsLease must be called with le.mu held.
+func (le *LeaderElection) holdsLease() bool {
+	return le.leader && time.Since(le.renewedAt) < le.lease
+}
+
+// Status returns the election state of this node.
+func (le *LeaderElection) Status() LeaderStatus {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	return LeaderStatus{NodeID: le.nodeID, Leader: le.current, IsLeader: le.holdsLease()}
+}
+
+// Resign releases the lease so another node can take over immediately.
+func (le *LeaderElection) Resign() {
+	if err := releaseLeaseScript.Run(ctx, le.client, []string{redisKey(leaderKey)}, le.nodeID).Err(); err != nil {
+		logError("Failed to release leader lease: %v", err)
+	}
+	le.mu.Lock()
+	le.leader = false
+	le.mu.Unlock()
+	rotationIsLeader.Set(0)
+}
+
+// isFollower reports whether rotation is delegated to another node.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) isFollower() bool {
+	return pm.election != nil && !pm.election.IsLeader()
+}
+
+// requestRotation asks the leader to rotate on behalf of a follower.
+func requestRotation(client redis.UniversalClient, reason string) {
+	if err := client.Publish(ctx, redisKey(rotationRequestsChannel), reason).Err(); err != nil {
+		logError("Failed to forward rotation request to leader: %v", err)
+	}
+}
+
+// followUpdates applies the active proxy published by the leader while this
+// node is a follower, executes rotations requested by followers while it is
+// the leader, and applies the rotation controls set on any node.
+func (pm *ProxyManager) followUpdates(client redis.UniversalClient) {
+	pubsub := client.Subscribe(ctx, redisKey(proxyUpdatesChannel), redisKey(rotationRequestsChannel), redisKey(rotationControlChannel))
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		leader := pm.election.IsLeader()
+		switch {
+		case msg.Channel == redisKey(rotationControlChannel):
+			pm.applyControl(msg.Payload)
+		case msg.Channel == redisKey(proxyUpdatesChannel) && !leader:
+			pm.applyActiveProxy(msg.Payload)
+		case msg.Channel == redisKey(rotationRequestsChannel) && leader:
+			logInfo("Rotation requested by a follower: %s", msg.Payload)
+			if rotationTriggers.AllowForwarded(msg.Payload) {
+				pm.switchProxy(msg.Payload)
+			}
+		}
+	}
+}
+
+// applyActiveProxy makes the proxy published by the leader the current one
+// and adopts the leader's epoch, so rotation tokens signed by any instance
+// verify on the others.
+func (pm *ProxyManager) applyActiveProxy(message string) {
+	epoch, activeProxy := parseProxyUpdate(message)
+	published, err := url.Parse(activeProxy)
+	if err != nil {
+		logError("Invalid proxy update %q: %v", activeProxy, err)
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, proxy := range pm.proxies {
+		if proxy.Port() != published.Port() {
+			continue
+		}
+		if !sameProxy(proxy, pm.currentProxy) {
+			pm.retireProxy(pm.currentProxy)
+			pm.currentProxy = proxy
+			logInfo("Following leader: switched to proxy %s (epoch %d)", proxy, epoch)
+		}
+		if epoch != 0 {
+			pm.epoch = epoch
+		}
+		return
+	}
+	logWarning("Leader published unknown proxy %s", activeProxy)
+}
+
+// loadEpoch adopts the epoch held by the state store, e.g. when joining as a
+// follower or after missing updates during a Redis outage.
+func (pm *ProxyManager) loadEpoch() {
+	value, found, err := stateStore.Get(proxyEpochKey)
+	if err != nil {
+		logError("Failed to read rotation epoch: %v", err)
+		return
+	}
+	if !found {
+		return
+	}
+	epoch, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		logError("Invalid rotation epoch %q in the state store", value)
+		return
+	}
+	pm.mu.Lock()
+	if epoch > pm.epoch {
+		pm.epoch = epoch
+	}
+	pm.mu.Unlock()
+}
+
+// rotationControl is the operator state of rotation (/api/rotation), shared
+// by every node when leader election is enabled. It is kept in the state
+// store so a newly elected leader honours a pause or pin set before. The
+// pinned proxy is identified by its port, like published proxy updates, since
+// every node builds proxy URLs from its own address.
+type rotationControl struct {
+	Paused     bool          `json:"paused"`
+	PinnedPort string        `json:"pinned_port,omitempty"`
+	Interval   time.Duration `json:"interval"`
+	Jitter     time.Duration `json:"jitter"`
+}
+
+// shareControl stores and publishes the rotation controls of this node.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) shareControl() {
+	if pm.election == nil {
+		return
+	}
+	control := rotationControl{Paused: pm.paused, Interval: pm.interval, Jitter: pm.jitter}
+	if pm.pinned != nil {
+		control.PinnedPort = pm.pinned.Port()
+	}
+	data, err := json.Marshal(control)
+	if err != nil {
+		return
+	}
+	if err := stateStore.Set(rotationControlKey, string(data), 0); err != nil {
+		logError("Failed to store rotation controls: %v", err)
+	}
+	if err := stateStore.Publish(rotationControlChannel, string(data)); err != nil {
+		logError("Failed to publish rotation controls: %v", err)
+	}
+}
+
+// loadControl applies the rotation controls held by the state store.
+func (pm *ProxyManager) loadControl() {
+	data, found, err := stateStore.Get(rotationControlKey)
+	if err != nil {
+		logError("Failed to read rotation controls: %v", err)
+		return
+	}
+	if found {
+		pm.applyControl(data)
+	}
+}
+
+// applyControl adopts rotation controls set on any node. The leader
+// switches to a newly pinned proxy.
+func (pm *ProxyManager) applyControl(message string) {
+	var control rotationControl
+	if err := json.Unmarshal([]byte(message), &control); err != nil {
+		logError("Invalid rotation controls %q: %v", message, err)
+		return
+	}
+
+	pm.mu.Lock()
+	pm.paused = control.Paused
+	rescheduled := control.Interval >= time.Second && (control.Interval != pm.interval || control.Jitter != pm.jitter)
+	if rescheduled {
+		pm.interval, pm.jitter = control.Interval, control.Jitter
+	}
+	pm.pinned = nil
+	for _, proxy := range pm.proxies {
+		if control.PinnedPort != "" && proxy.Port() == control.PinnedPort {
+			pm.pinned = proxy
+		}
+	}
+	if control.PinnedPort != "" && pm.pinned == nil {
+		logWarning("Rotation pinned to unknown proxy port %s, ignoring the pin", control.PinnedPort)
+	}
+	if pm.pinned != nil && !pm.isFollower() && !sameProxy(pm.pinned, pm.currentProxy) {
+		pm.setCurrentProxy(pm.pinned, "pin")
+	}
+	pm.mu.Unlock()
+
+	if rescheduled {
+		pm.resetTicker()
+	}
+}
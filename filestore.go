@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileStoreFlushInterval bounds how much state a crash may lose.
+const fileStoreFlushInterval = time.Second
+
+// FileStore is a MemoryStore persisted to a JSON file, so a single instance
+// keeps its bans, blacklists and queue across restarts without Redis.
+// Writes are batched and the file is replaced atomically; a crash loses the
+// changes made since the last flush, up to fileStoreFlushInterval.
+type FileStore struct {
+	*MemoryStore
+	path  string
+	dirty bool
+	done  chan struct{}
+}
+
+type fileStoreSnapshot struct {
+	Values  map[string]*memoryValue  `json:"values"`
+	Streams map[string]*memoryStream `json:"streams"`
+}
+
+// OpenFileStore loads the store from path, creating it on first use.
+func OpenFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{MemoryStore: NewMemoryStore(), path: path, done: make(chan struct{})}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var snapshot fileStoreSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, err
+		}
+		if snapshot.Values != nil {
+			fs.values = snapshot.Values
+		}
+		if snapshot.Streams != nil {
+			fs.streams = snapshot.Streams
+		}
+		for _, stream := range fs.streams {
+			if stream.Groups == nil {
+				stream.Groups = make(map[string]*memoryGroup)
+			}
+			for _, group := range stream.Groups {
+				if group.Pending == nil {
+					group.Pending = make(map[string]bool)
+				}
+			}
+		}
+		logInfo("Loaded state from %s (%d keys, %d streams)", path, len(fs.values), len(fs.streams))
+	}
+
+	fs.changed = func() { fs.dirty = true }
+	go fs.run()
+	return fs, nil
+}
+
+func (fs *FileStore) run() {
+	ticker := time.NewTicker(fileStoreFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fs.done:
+			return
+		case <-ticker.C:
+			if err := fs.flush(); err != nil {
+				logError("Failed to save state to %s: %v", fs.path, err)
+			}
+		}
+	}
+}
+
+// flush writes the state to disk if it changed since the last flush.
+func (fs *FileStore) flush() error {
+	fs.mu.Lock()
+	if !fs.dirty {
+		fs.mu.Unlock()
+		return nil
+	}
+	for key := range fs.values {
+		fs.value(key) // drop expired keys
+	}
+	data, err := json.Marshal(fileStoreSnapshot{Values: fs.values, Streams: fs.streams})
+	fs.dirty = false
+	fs.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(fs.path, data)
+	}
+	if err != nil {
+		fs.mu.Lock()
+		fs.dirty = true
+		fs.mu.Unlock()
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Close flushes the state one last time.
+func (fs *FileStore) Close() error {
+	close(fs.done)
+	fs.MemoryStore.Close()
+	return fs.flush()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const handoffHopsCookie = "morph_handoff_hops"
+
+// Handoff modes used when a request reaches a proxy that is not active.
+const (
+	HandoffAuto      = "auto"      // 302 for GET/HEAD, 307 otherwise
+	HandoffFound     = "found"     // 302, legacy behaviour
+	HandoffTemporary = "temporary" // 307, keeps method and body
+	HandoffPermanent = "permanent" // 308, keeps method and body
+	HandoffForward   = "forward"   // pass the request to the active proxy's handler without redirecting
+)
+
+var handoffConfig = &HandoffConfig{DefaultMode: HandoffAuto, MaxHops: 5}
+
+var proxyHandoffsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_handoffs_total",
+		Help: "Total number of requests handed off to the active proxy, by mode",
+	},
+	[]string{"proxy_id", "mode"},
+)
+
+func init() {
+	prometheus.MustRegister(proxyHandoffsTotal)
+}
+
+type HandoffRule struct {
+	PathPrefix string   `yaml:"path_prefix"`
+	Methods    []string `yaml:"methods,omitempty"`
+	Mode       string   `yaml:"mode"`
+}
+
+type HandoffConfig struct {
+	DefaultMode string        `yaml:"default_mode"`
+	MaxHops     int           `yaml:"max_hops"`
+	Routes      []HandoffRule `yaml:"routes"`
+}
+
+// LoadHandoffConfig loads the handoff routes from the given file.
+func LoadHandoffConfig(filepath string) (*HandoffConfig, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := HandoffConfig{DefaultMode: HandoffAuto, MaxHops: 5}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks that every mode is known.
+func (config *HandoffConfig) Validate() error {
+	if !validHandoffMode(config.DefaultMode) {
+		return fmt.Errorf("invalid default handoff mode %q", config.DefaultMode)
+	}
+	for _, route := range config.Routes {
+		if !validHandoffMode(route.Mode) {
+			return fmt.Errorf("invalid handoff mode %q for path %s", route.Mode, route.PathPrefix)
+		}
+	}
+	return nil
+}
+
+// UsesForward reports whether any request may be forwarded.
+func (config *HandoffConfig) UsesForward() bool {
+	if config.DefaultMode == HandoffForward {
+		return true
+	}
+	for _, route := range config.Routes {
+		if route.Mode == HandoffForward {
+			return true
+		}
+	}
+	return false
+}
+
+func validHandoffMode(mode string) bool {
+	switch mode {
+	case HandoffAuto, HandoffFound, HandoffTemporary, HandoffPermanent, HandoffForward:
+		return true
+	}
+	return false
+}
+
+// modeFor returns the handoff mode of the first route matching the request.
+func (config *HandoffConfig) modeFor(r *http.Request) string {
+	for _, route := range config.Routes {
+		if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if len(route.Methods) > 0 && !containsFold(route.Methods, r.Method) {
+			continue
+		}
+		return route.Mode
+	}
+	return config.DefaultMode
+}
+
+// handoff sends a request that reached a non-active proxy to target and
+// returns the response status. Forward mode falls back to a 307 redirect
+// when the request cannot be forwarded.
+func handoff(w http.ResponseWriter, r *http.Request, proxyID, target string, pm *ProxyManager) string {
+	mode := handoffConfig.modeFor(r)
+	if mode == HandoffForward {
+		if status, ok := forward(w, r, proxyID, target, pm); ok {
+			return status
+		}
+		mode = HandoffTemporary
+	}
+
+	hops := 0
+	if cookie, err := r.Cookie(handoffHopsCookie); err == nil {
+		hops, _ = strconv.Atoi(cookie.Value)
+	}
+	if handoffConfig.MaxHops > 0 && hops >= handoffConfig.MaxHops {
+		proxyHandoffsTotal.WithLabelValues(proxyID, "loop").Inc()
+		logWarning("%s stopped handoff loop for %s after %d hops", proxyID, r.RemoteAddr, hops)
+		clearHandoffHops(w, r)
+		http.Error(w, "Loop Detected: too many proxy handoffs", http.StatusLoopDetected)
+		return strconv.Itoa(http.StatusLoopDetected)
+	}
+
+	code := http.StatusFound
+	switch mode {
+	case HandoffTemporary:
+		code = http.StatusTemporaryRedirect
+	case HandoffPermanent:
+		code = http.StatusPermanentRedirect
+	case HandoffAuto:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusTemporaryRedirect
+		}
+	}
+
+	// Cookies are shared across ports, so the counter follows the client
+	// from one proxy to the next.
+	http.SetCookie(w, &http.Cookie{
+		Name:     handoffHopsCookie,
+		Value:    strconv.Itoa(hops + 1),
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		Secure:   true,
+	})
+	proxyHandoffsTotal.WithLabelValues(proxyID, mode).Inc()
+	http.Redirect(w, r, target, code)
+	return strconv.Itoa(code)
+}
+
+// forward passes the request, method and body included, to the handler of
+// the proxy listening on target's port in this process. That handler runs
+// its own ACL and detection checks and proxies to its own backend, so
+// forwarding hides the rotation from the client without serving anything
+// from the stale port. The rotation token was verified by the caller and is
+// not checked again. It returns false when target is not served here or the
+// request was already forwarded once, and the caller redirects instead.
+func forward(w http.ResponseWriter, r *http.Request, proxyID, target string, pm *ProxyManager) (string, bool) {
+	targetURL, err := url.Parse(target)
+	if err != nil || targetURL.Port() == "" || pm.registry == nil || r.Context().Value("handoffForwarded") != nil {
+		return "", false
+	}
+	next, ok := pm.registry.Handler(targetURL.Port())
+	if !ok {
+		logWarning("%s cannot forward to %s, no such listener here; redirecting instead", proxyID, target)
+		return "", false
+	}
+
+	proxyHandoffsTotal.WithLabelValues(proxyID, HandoffForward).Inc()
+	logInfo("%s forwarding %s %s to %s", proxyID, r.Method, r.URL.Path, targetURL.Host)
+	forwarded := r.WithContext(context.WithValue(r.Context(), "handoffForwarded", true))
+	forwarded.Host = targetURL.Host
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(recorder, forwarded)
+	return strconv.Itoa(recorder.status), true
+}
+
+// statusRecorder captures the status written by a forwarded handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed responses.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// clearHandoffHops resets the hop counter once a request has been served.
+func clearHandoffHops(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(handoffHopsCookie); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     handoffHopsCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	proxyHealthStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_health_status",
+			Help: "Health of each proxy as seen by the health checker (1 = healthy, 0 = unhealthy)",
+		},
+		[]string{"proxy_id"},
+	)
+	proxyHealthChecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_health_checks_total",
+			Help: "Total number of health probes per proxy and result",
+		},
+		[]string{"proxy_id", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(proxyHealthStatus, proxyHealthChecksTotal)
+}
+
+// HealthCheckConfig configures the active health checker.
+type HealthCheckConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int    // consecutive successes before a proxy is marked healthy
+	Fall     int    // consecutive failures before a proxy is marked unhealthy
+	Fallback string // "keep" the current proxy or rotate among "any" proxy when none is healthy
+}
+
+// ProxyHealth is the health state of a single proxy.
+type ProxyHealth struct {
+	Proxy                string    `json:"proxy"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	LastCheck            time.Time `json:"last_check"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+// HealthChecker periodically probes the /health endpoint of every proxy.
+type HealthChecker struct {
+	mu       sync.RWMutex
+	config   HealthCheckConfig
+	states   map[string]*ProxyHealth
+	client   *http.Client
+	targets  func() []*url.URL
+	onChange func(proxy string, healthy bool)
+}
+
+// EnableHealthChecks starts probing the managed proxies and restricts
+// rotation to the healthy ones.
+func (pm *ProxyManager) EnableHealthChecks(config HealthCheckConfig) {
+	if config.Interval <= 0 {
+		logWarning("Health checks disabled")
+		return
+	}
+	if config.Rise <= 0 {
+		config.Rise = 1
+	}
+	if config.Fall <= 0 {
+		config.Fall = 1
+	}
+	if config.Fallback != "any" {
+		config.Fallback = "keep"
+	}
+
+	hc := &HealthChecker{
+		config: config,
+		states: make(map[string]*ProxyHealth),
+		client: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				// Probes target our own listeners, which may use a self-signed certificate.
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		targets: func() []*url.URL {
+			pm.mu.Lock()
+			defer pm.mu.Unlock()
+			targets := make([]*url.URL, len(pm.proxies))
+			copy(targets, pm.proxies)
+			return targets
+		},
+		onChange: func(proxy string, healthy bool) {
+			if !healthy && proxy == pm.GetProxy().String() {
+				logWarning("Current proxy %s is unhealthy, switching immediately", proxy)
+				pm.switchProxy("unhealthy")
+			}
+		},
+	}
+
+	pm.mu.Lock()
+	pm.health = hc
+	if strategy, ok := pm.strategy.(*healthAwareStrategy); ok {
+		strategy.probe = hc.IsHealthy
+		strategy.fallback = config.Fallback
+	}
+	pm.mu.Unlock()
+
+	logInfo("Health checks enabled (interval: %s, rise: %d, fall: %d, fallback: %s)", config.Interval, config.Rise, config.Fall, config.Fallback)
+	go hc.run()
+}
+
+func (hc *HealthChecker) run() {
+	ticker := time.NewTicker(hc.config.Interval)
+	defer ticker.Stop()
+	for {
+		hc.checkAll()
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll probes every proxy concurrently and forgets removed proxies.
+func (hc *HealthChecker) checkAll() {
+	targets := hc.targets()
+	seen := make(map[string]bool, len(targets))
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		seen[target.String()] = true
+		wg.Add(1)
+		go func(target *url.URL) {
+			defer wg.Done()
+			hc.check(target)
+		}(target)
+	}
+	wg.Wait()
+
+	hc.mu.Lock()
+	for proxy := range hc.states {
+		if !seen[proxy] {
+			delete(hc.states, proxy)
+			proxyHealthStatus.DeleteLabelValues(proxy)
+		}
+	}
+	hc.mu.Unlock()
+}
+
+func (hc *HealthChecker) check(target *url.URL) {
+	proxy := target.String()
+	err := hc.probe(target)
+
+	hc.mu.Lock()
+	state, ok := hc.states[proxy]
+	if !ok {
+		// New proxies are considered healthy until proven otherwise.
+		state = &ProxyHealth{Proxy: proxy, Healthy: true}
+		hc.states[proxy] = state
+	}
+	wasHealthy := state.Healthy
+	state.LastCheck = time.Now()
+	if err != nil {
+		state.ConsecutiveSuccesses = 0
+		state.ConsecutiveFailures++
+		state.LastError = err.Error()
+		if state.ConsecutiveFailures >= hc.config.Fall {
+			state.Healthy = false
+		}
+	} else {
+		state.ConsecutiveFailures = 0
+		state.ConsecutiveSuccesses++
+		state.LastError = ""
+		if state.ConsecutiveSuccesses >= hc.config.Rise {
+			state.Healthy = true
+		}
+	}
+	healthy := state.Healthy
+	hc.mu.Unlock()
+
+	if err != nil {
+		proxyHealthChecksTotal.WithLabelValues(proxy, "failure").Inc()
+	} else {
+		proxyHealthChecksTotal.WithLabelValues(proxy, "success").Inc()
+	}
+	if healthy {
+		proxyHealthStatus.WithLabelValues(proxy).Set(1)
+	} else {
+		proxyHealthStatus.WithLabelValues(proxy).Set(0)
+	}
+
+	if healthy != wasHealthy {
+		if healthy {
+			logSuccess("Proxy %s is healthy again", proxy)
+		} else {
+			logError("Proxy %s marked unhealthy: %v", proxy, err)
+		}
+		hc.onChange(proxy, healthy)
+	}
+}
+
+func (hc *HealthChecker) probe(target *url.URL) error {
+	resp, err := hc.client.Get(target.String() + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// IsHealthy reports whether the proxy is healthy. Unknown proxies are healthy.
+func (hc *HealthChecker) IsHealthy(proxy *url.URL) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	state, ok := hc.states[proxy.String()]
+	return !ok || state.Healthy
+}
+
+// States returns a snapshot of the health of every proxy.
+func (hc *HealthChecker) States() []ProxyHealth {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	states := make([]ProxyHealth, 0, len(hc.states))
+	for _, state := range hc.states {
+		states = append(states, *state)
+	}
+	return states
+}
+
+// rotationCandidates returns the proxies the strategy may choose from.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) rotationCandidates() []*url.URL {
+	candidates := make([]*url.URL, len(pm.proxies))
+	copy(candidates, pm.proxies)
+	if pm.health == nil {
+		return candidates
+	}
+	// The health-aware strategy filters the candidates itself.
+	if _, ok := pm.strategy.(*healthAwareStrategy); ok {
+		return candidates
+	}
+
+	var healthy []*url.URL
+	for _, proxy := range candidates {
+		if pm.health.IsHealthy(proxy) {
+			healthy = append(healthy, proxy)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+
+	if pm.health.config.Fallback == "any" {
+		logWarning("No healthy proxy available, rotating among all proxies")
+		return candidates
+	}
+	logWarning("No healthy proxy available, keeping current proxy %s", pm.currentProxy)
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const rotationHistoryStream = "rotation_history"
+
+// nodeID identifies this MorphProxy instance in the rotation history.
+var nodeID string
+
+// rotationHistoryMaxLen caps the rotation history stream (approximately).
+var rotationHistoryMaxLen int64 = 10000
+
+// RotationRecord is one entry of the rotation history.
+type RotationRecord struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	OldProxy  string    `json:"old_proxy"`
+	NewProxy  string    `json:"new_proxy"`
+	Strategy  string    `json:"strategy"`
+	Reason    string    `json:"reason"`
+	NodeID    string    `json:"node_id"`
+}
+
+// recordRotation appends a proxy switch to the rotation history stream.
+func (pm *ProxyManager) recordRotation(old, new *url.URL, reason string) {
+	if rdb == nil {
+		return
+	}
+	if !redisUp() {
+		logWarning("Redis unreachable, rotation from %s to %s not recorded in history", old, new)
+		return
+	}
+	oldProxy := ""
+	if old != nil {
+		oldProxy = pm.publicURL(old)
+	}
+	err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: redisKey(rotationHistoryStream),
+		MaxLen: rotationHistoryMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"timestamp": time.Now().UnixMilli(),
+			"old_proxy": oldProxy,
+			"new_proxy": pm.publicURL(new),
+			"strategy":  pm.strategy.Name(),
+			"reason":    reason,
+			"node_id":   nodeID,
+		},
+	}).Err()
+	if err != nil {
+		logError("Failed to record rotation in history: %v", err)
+	}
+}
+
+// RotationHistory returns the rotations between from and to (inclusive),
+// oldest first. A zero time leaves the bound open.
+func RotationHistory(from, to time.Time, limit int64) ([]RotationRecord, error) {
+	start, end := "-", "+"
+	if !from.IsZero() {
+		start = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		end = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	messages, err := rdb.XRangeN(ctx, redisKey(rotationHistoryStream), start, end, limit).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseRotationRecords(messages), nil
+}
+
+// RotationAt returns the last rotation that happened at or before t, i.e.
+// the one whose proxy was live at that time.
+func RotationAt(t time.Time) (*RotationRecord, error) {
+	messages, err := rdb.XRevRangeN(ctx, redisKey(rotationHistoryStream), strconv.FormatInt(t.UnixMilli(), 10), "-", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := parseRotationRecords(messages)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+func parseRotationRecords(messages []redis.XMessage) []RotationRecord {
+	records := make([]RotationRecord, 0, len(messages))
+	for _, message := range messages {
+		record := RotationRecord{ID: message.ID}
+		record.OldProxy, _ = message.Values["old_proxy"].(string)
+		record.NewProxy, _ = message.Values["new_proxy"].(string)
+		record.Strategy, _ = message.Values["strategy"].(string)
+		record.Reason, _ = message.Values["reason"].(string)
+		record.NodeID, _ = message.Values["node_id"].(string)
+		if value, ok := message.Values["timestamp"].(string); ok {
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+				record.Timestamp = time.UnixMilli(ms)
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or Unix seconds.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or Unix seconds", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// handleRotations returns the rotation history. Supported query parameters:
+// from, to and limit, or at to get the rotation live at a given time.
+func handleRotations(w http.ResponseWriter, r *http.Request) {
+	logAPIRequest(r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rdb == nil {
+		http.Error(w, "Rotation history requires the redis state store", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+
+	if at := query.Get("at"); at != "" {
+		t, err := parseTimeParam(at)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record, err := RotationAt(t)
+		if err != nil {
+			logError("Failed to read rotation history: %v", err)
+			http.Error(w, "Failed to read rotation history", http.StatusInternalServerError)
+			return
+		}
+		if record == nil {
+			http.Error(w, "No rotation recorded before this time", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(record)
+		return
+	}
+
+	from, err := parseTimeParam(query.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(query.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := int64(100)
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := RotationHistory(from, to, limit)
+	if err != nil {
+		logError("Failed to read rotation history: %v", err)
+		http.Error(w, "Failed to read rotation history", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(records)
+}
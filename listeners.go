@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// listenFdsStart is the first inherited file descriptor, after stdin,
+	// stdout and stderr (sd_listen_fds(3)).
+	listenFdsStart = 3
+
+	// inheritedFdsEnv tells a re-executed MorphProxy how many listeners its
+	// parent passed through ExtraFiles.
+	inheritedFdsEnv = "MORPHPROXY_INHERITED_FDS"
+
+	// inheritedStateEnv gives the file descriptor of the pipe carrying the
+	// parent's upgradeState.
+	inheritedStateEnv = "MORPHPROXY_INHERITED_STATE"
+)
+
+// upgradeState is the in-memory state a re-executed MorphProxy needs to keep
+// honouring what its parent handed out: rotation tokens signed with the
+// parent's key and epoch, and sessions on the current or retired proxies.
+// It goes through a pipe rather than the environment so the token key is
+// not exposed in /proc.
+type upgradeState struct {
+	TokenKey string              `json:"token_key,omitempty"`
+	Epoch    uint64              `json:"epoch"`
+	Current  string              `json:"current,omitempty"`
+	Previous []upgradeRetirement `json:"previous,omitempty"`
+}
+
+type upgradeRetirement struct {
+	URL       string    `json:"url"`
+	RetiredAt time.Time `json:"retired_at"`
+}
+
+// inheritedState is the state passed by the parent during a SIGUSR2 upgrade,
+// or nil.
+var inheritedState *upgradeState
+
+// upgradeReadyTimeout is how long a re-executed child must stay up before
+// the parent hands over and starts draining.
+var upgradeReadyTimeout = 5 * time.Second
+
+var (
+	inheritedMu sync.Mutex
+	inherited   = make(map[string]net.Listener) // keyed by port
+)
+
+// inheritListeners collects the listening sockets passed by systemd socket
+// activation or by a parent MorphProxy during a SIGUSR2 upgrade.
+func inheritListeners() error {
+	count, source := 0, ""
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		count, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return fmt.Errorf("invalid LISTEN_FDS: %v", err)
+		}
+		source = "systemd"
+	} else if value := os.Getenv(inheritedFdsEnv); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", inheritedFdsEnv, err)
+		}
+		source = "parent process"
+		if err := readInheritedState(); err != nil {
+			return err
+		}
+	}
+	// The variables must not leak into processes we start ourselves.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(inheritedFdsEnv)
+	os.Unsetenv(inheritedStateEnv)
+
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			logWarning("Ignoring inherited file descriptor %d: %v", fd, err)
+			continue
+		}
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		if err != nil {
+			listener.Close()
+			continue
+		}
+		inherited[port] = listener
+		logInfo("Inherited listener on %s from %s", listener.Addr(), source)
+	}
+	return nil
+}
+
+// readInheritedState reads the upgradeState written by the parent.
+func readInheritedState() error {
+	fd, err := strconv.Atoi(os.Getenv(inheritedStateEnv))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", inheritedStateEnv, err)
+	}
+	file := os.NewFile(uintptr(fd), "upgrade-state")
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("failed to read the parent's state: %v", err)
+	}
+	var state upgradeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid state from the parent: %v", err)
+	}
+	inheritedState = &state
+	logInfo("Inherited rotation state from parent process (epoch %d)", state.Epoch)
+	return nil
+}
+
+// listen returns the inherited listener for the address' port if there is
+// one, and binds a new socket otherwise.
+func listen(address string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	inheritedMu.Lock()
+	listener, ok := inherited[port]
+	delete(inherited, port)
+	inheritedMu.Unlock()
+	if ok {
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// closeUnusedListeners releases inherited sockets nothing claimed during
+// startup, e.g. ports that are no longer configured.
+func closeUnusedListeners() {
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	for port, listener := range inherited {
+		logWarning("Closing unused inherited listener on port %s", port)
+		listener.Close()
+		delete(inherited, port)
+	}
+}
+
+// upgrade re-executes the current binary and passes it every listening
+// socket and the rotation state, so the new process accepts connections,
+// and the tokens and grace windows of this one, while this one drains.
+// It fails if the state cannot be handed over or if the child exits before
+// upgradeReadyTimeout.
+func upgrade(listeners []net.Listener, state upgradeState) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	stateData, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode the rotation state: %v", err)
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("cannot pass listener %s of type %T", listener.Addr(), listener)
+		}
+		file, err := tcpListener.File()
+		if err != nil {
+			return fmt.Errorf("failed to duplicate listener %s: %v", listener.Addr(), err)
+		}
+		files = append(files, file)
+	}
+
+	// The state fits in the pipe buffer, so it is written before the child
+	// starts and the write end closed for the child to read up to EOF.
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create the state pipe: %v", err)
+	}
+	defer stateReader.Close()
+	_, err = stateWriter.Write(stateData)
+	if closeErr := stateWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hand over the rotation state: %v", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, stateReader)
+	cmd.Env = append(os.Environ(),
+		inheritedFdsEnv+"="+strconv.Itoa(len(files)),
+		inheritedStateEnv+"="+strconv.Itoa(listenFdsStart+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	logInfo("Started new process %d with %d listeners", cmd.Process.Pid, len(files))
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		return fmt.Errorf("new process exited during startup: %v", err)
+	case <-time.After(upgradeReadyTimeout):
+		return nil
+	}
+}
+
+// upgradeState returns the rotation state to hand over to a new process.
+func (pm *ProxyManager) upgradeState() upgradeState {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	state := upgradeState{Epoch: pm.epoch}
+	if rotationTokens != nil {
+		state.TokenKey = string(rotationTokens.key)
+	}
+	if pm.currentProxy != nil {
+		state.Current = pm.currentProxy.String()
+	}
+	for _, previous := range pm.previous {
+		state.Previous = append(state.Previous, upgradeRetirement{URL: previous.url.String(), RetiredAt: previous.retiredAt})
+	}
+	return state
+}
+
+// restoreUpgradeState resumes the rotation where the parent left it. The
+// current proxy is only restored if it is still configured.
+func (pm *ProxyManager) restoreUpgradeState(state upgradeState) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if state.Epoch > pm.epoch {
+		pm.epoch = state.Epoch
+	}
+	for _, proxy := range pm.proxies {
+		if proxy.String() == state.Current {
+			pm.currentProxy = proxy
+		}
+	}
+	pm.previous = nil
+	for _, previous := range state.Previous {
+		if parsed, err := url.Parse(previous.URL); err == nil {
+			pm.previous = append(pm.previous, retiredProxy{url: parsed, retiredAt: previous.RetiredAt})
+		}
+	}
+}
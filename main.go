@@ -76,7 +76,7 @@ func generateAPIKey() string {
 	return hex.EncodeToString(key)
 }
 
-func NewProxyManager(proxyURLs []string, domain string) *ProxyManager {
+func NewProxyManager(proxyURLs []string, domain string, rotation RotationConfig) *ProxyManager {
 	logInfo("Initializing ProxyManager with domain: %s", domain)
 	proxies := make([]*url.URL, len(proxyURLs))
 	for i, proxyURL := range proxyURLs {
@@ -87,12 +87,27 @@ func NewProxyManager(proxyURLs []string, domain string) *ProxyManager {
 		proxies[i] = url
 	}
 
+	strategy, err := NewRotationStrategy(rotation.Strategy, rotation.Weights)
+	if err != nil {
+		log.Fatalf("Invalid rotation strategy: %v", err)
+	}
+	if rotation.Interval <= 0 {
+		rotation.Interval = 10 * time.Second
+	}
+	logInfo("Rotation strategy: %s, interval: %s, jitter: %s", strategy.Name(), rotation.Interval, rotation.Jitter)
+
 	pm := &ProxyManager{
 		proxies:      proxies,
 		currentProxy: proxies[0],
-		ticker:       time.NewTicker(10 * time.Second),
 		domain:       domain, // Initialisez le champ
+		strategy:     strategy,
+		interval:     rotation.Interval,
+		jitter:       rotation.Jitter,
+		grace:        rotation.Grace,
+		graceCount:   rotation.GraceCount,
 	}
+	pm.nextRotation = time.Now().Add(pm.nextInterval())
+	pm.ticker = time.NewTicker(time.Until(pm.nextRotation))
 
 	go pm.startAutoSwitch()
 
@@ -147,10 +162,137 @@ func main() {
 	domain := flag.String("d", "", "Domain name to use for the proxy (e.g., jxlio.fr)")
 	certFile := flag.String("crt", "", "Path to the SSL certificate file")
 	keyFile := flag.String("key", "", "Path to the SSL key file")
+	rotationStrategy := flag.String("rotation-strategy", "random", "Proxy rotation strategy (random, round-robin, weighted, health-aware[:strategy])")
+	rotationInterval := flag.Duration("rotation-interval", 10*time.Second, "Interval between proxy rotations")
+	rotationJitter := flag.Duration("rotation-jitter", 0, "Maximum random jitter added to or removed from the rotation interval")
+	rotationWeights := flag.String("rotation-weights", "", "Comma-separated port=weight list for the weighted strategy (e.g., 8081=3,8082=1)")
+	rotationGrace := flag.Duration("rotation-grace", 0, "How long retired proxies keep serving existing sessions after a rotation (0 to disable)")
+	rotationGraceCount := flag.Int("rotation-grace-count", 1, "Number of previous proxies kept in the grace window")
+	handoffRulesFile := flag.String("handoff-rules", "", "Path to the YAML file defining per-route rotation handoff modes")
+	handoffMode := flag.String("handoff-mode", HandoffAuto, "Default rotation handoff mode (auto, found, temporary, permanent, or forward, which keeps stale ports serving)")
+	handoffMaxHops := flag.Int("handoff-max-hops", 5, "Maximum consecutive handoff redirects before answering 508 Loop Detected (0 for no limit)")
+	sessionTargeting := flag.Bool("session-targeting", false, "Assign each session its own proxy and rotation schedule instead of a global active proxy")
+	sessionRotationInterval := flag.Duration("session-rotation-interval", 0, "Per-session rotation interval (defaults to -rotation-interval)")
+	portRange := flag.String("port-range", "", "Port range for port hopping (e.g., 20000-29999); a fresh listener is opened on every rotation; not supported with -leader-election or -session-targeting")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long stopped or retired proxy listeners may take to drain")
+	tokenPolicy := flag.String("token-policy", "off", "Rotation token enforcement on proxy ports (off, reject, tarpit)")
+	tokenSecret := flag.String("token-secret", "", "HMAC secret for rotation tokens (random if empty; kept across SIGUSR2 upgrades, but not restarts or other instances)")
+	tokenTTL := flag.Duration("token-ttl", 2*time.Minute, "Lifetime of rotation tokens")
+	tokenEpochLag := flag.Uint64("token-epoch-lag", 1, "Number of rotations a rotation token stays valid for")
+	tokenMaxAge := flag.Duration("token-max-age", time.Hour, "How long rotation tokens are refreshed before clients must return to the entry point")
+	tokenTarpit := flag.Duration("token-tarpit", 10*time.Second, "Delay before answering rejected requests with the tarpit policy")
+	tokenTarpitMax := flag.Int("token-tarpit-max", 100, "Maximum number of rejected requests delayed at once with the tarpit policy; others are answered at once")
+	probePolicy := flag.String("probe-policy", "off", "Action on requests to non-active proxy ports without a valid session (off, log, ban, decoy); log, ban and decoy also add -probe-suspicion")
+	probeSuspicion := flag.Int("probe-suspicion", 5, "Suspicion rating added for every request to a non-active proxy port without a valid session or with another session's; stale sessions add none")
+	probeBanDuration := flag.Duration("probe-ban-duration", time.Hour, "How long sources are banned with the ban probe policy")
+	probeDecoyURL := flag.String("probe-decoy-url", "", "Decoy backend URL for the decoy probe policy")
+	triggerSuspicion := flag.Int("trigger-suspicion", 0, "Rotate immediately when a suspicion rating reaches this value (0 to disable)")
+	triggerMalicious := flag.Bool("trigger-malicious", false, "Rotate immediately when the detection service reports a malicious request")
+	triggerPortScan := flag.Bool("trigger-port-scan", false, "Rotate immediately when a port scan is detected")
+	triggerACLRules := flag.String("trigger-acl-rules", "", "Comma-separated ACL rule names that rotate immediately when they match")
+	triggerCooldown := flag.Duration("trigger-cooldown", 30*time.Second, "Minimum time between two rotations fired by the same trigger")
+	nodeIDFlag := flag.String("node-id", "", "Identifier of this instance in the rotation history (defaults to the hostname)")
+	historyMaxLen := flag.Int64("rotation-history-max", 10000, "Approximate maximum number of entries kept in the rotation history")
+	leaderElection := flag.Bool("leader-election", false, "Elect a single rotation leader among the instances sharing Redis")
+	leaderLease := flag.Duration("leader-lease", 15*time.Second, "Lease duration of the rotation leader")
+	healthInterval := flag.Duration("health-interval", 5*time.Second, "Interval between proxy health checks (0 to disable)")
+	healthTimeout := flag.Duration("health-timeout", 2*time.Second, "Timeout of a single proxy health check")
+	healthRise := flag.Int("health-rise", 2, "Consecutive successful checks before a proxy is marked healthy")
+	healthFall := flag.Int("health-fall", 3, "Consecutive failed checks before a proxy is marked unhealthy")
+	healthFallback := flag.String("health-fallback", "keep", "Behaviour when no proxy is healthy (keep the current proxy or rotate among any proxy)")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "Redis address, or comma-separated Sentinel or cluster seed addresses")
+	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis password (defaults to $REDIS_PASSWORD)")
+	redisDB := flag.Int("redis-db", 0, "Redis database number")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over TLS")
+	redisTLSInsecure := flag.Bool("redis-tls-insecure", false, "Skip verification of the Redis server certificate")
+	redisTLSServerName := flag.String("redis-tls-server-name", "", "Server name used to verify the Redis certificate")
+	redisMaster := flag.String("redis-sentinel-master", "", "Sentinel master name; -redis-addr then lists the Sentinels")
+	redisCluster := flag.Bool("redis-cluster", false, "Connect to a Redis Cluster; -redis-addr then lists the seed nodes")
+	activeProxyReconcile := flag.Duration("active-proxy-reconcile", 30*time.Second, "Interval between reconciliations of the cached active proxy with Redis (0 to disable)")
+	aclPersist := flag.String("acl-persist", ACLPersistFile, "Where ACL changes made through the API are saved: file (the -acl-file), store (the state store, shared by every instance) or none")
+	aclHistory := flag.Int64("acl-history", 100, "Number of ACL versions kept for diff and rollback (0 keeps them all)")
+	configWatchInterval := flag.Duration("config-watch-interval", 2*time.Second, "Interval between checks of the ACL and header rules files for changes (0 to disable)")
+	configFile := flag.String("config", "", "Path to the versioned YAML configuration file; command-line flags override it")
+	listenAddr := flag.String("listen", "0.0.0.0:443", "Listen address of the entry server")
+	maxRequests := flag.Int("max-requests", 500, "Maximum number of requests a client address may send to one proxy server")
+	maxSuspicion := flag.Int("max-suspicion", 20, "Suspicion rating above which a client is refused")
+	detectionURLFlag := flag.String("detection-url", "http://localhost:3000", "URL of the attack detection service")
+	jwtTTLFlag := flag.Duration("jwt-ttl", 24*time.Hour, "Lifetime of session tokens")
+	stateStoreKind := flag.String("state-store", "redis", "State backend (redis, memory, or file for a single instance without Redis)")
+	stateFile := flag.String("state-file", "morphproxy-state.json", "Path of the state file used by the file state store; it is saved once a second, so a crash loses up to the last second of changes")
+	redisCheckInterval := flag.Duration("redis-check-interval", 2*time.Second, "Interval between Redis health checks")
+	redisFailPolicy := flag.String("redis-fail-policy", "", "Per-subsystem behaviour while Redis is down, as subsystem=local|open|closed (e.g., blacklist=closed,rate-limit=local,bans=local)")
+	redisPrefix := flag.String("redis-prefix", "", "Prefix added to every Redis key, stream and channel (e.g., morph:prod:)")
 	flag.Parse()
 
+	var config *Config
+	if *configFile != "" {
+		loaded, data, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		if err := loaded.ApplyFlags(data); err != nil {
+			log.Fatalf("Invalid configuration %s: %v", *configFile, err)
+		}
+		config = loaded
+	}
+	maxRequestsPerClient = *maxRequests
+	detectionURL = *detectionURLFlag
+	jwtTTL = *jwtTTLFlag
+
 	var serverIP string
 	configureLogger(*verbose)
+	if err := inheritListeners(); err != nil {
+		log.Fatalf("Failed to inherit listeners: %v", err)
+	}
+
+	var err error
+	degradedPolicy, err = parseDegradedPolicy(*redisFailPolicy)
+	if err != nil {
+		log.Fatalf("Invalid Redis failure policy: %v", err)
+	}
+	if *stateStoreKind == "redis" {
+		client, err := NewRedisClient(RedisConfig{
+			Addrs:         parseRedisAddrs(*redisAddr),
+			Password:      *redisPassword,
+			DB:            *redisDB,
+			TLS:           *redisTLS,
+			TLSInsecure:   *redisTLSInsecure,
+			TLSServerName: *redisTLSServerName,
+			MasterName:    *redisMaster,
+			Cluster:       *redisCluster,
+			KeyPrefix:     *redisPrefix,
+		})
+		if err != nil {
+			log.Fatalf("Invalid Redis configuration: %v", err)
+		}
+		rdb = client
+		redisMonitor = NewRedisMonitor(rdb, *redisCheckInterval)
+	} else {
+		logInfo("Running standalone with the %s state store", *stateStoreKind)
+	}
+	stateStore, err = NewStateStore(*stateStoreKind, *stateFile)
+	if err != nil {
+		log.Fatalf("Failed to open state store: %v", err)
+	}
+	// Registered first so the store (and the shared Redis client) is closed last.
+	onShutdown(func() { stateStore.Close() })
+	if redisMonitor != nil {
+		redisMonitor.OnRecover(func() {
+			localFallback.replay(stateStore)
+		})
+		redisMonitor.Start()
+	}
+
+	nodeID = *nodeIDFlag
+	if nodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "morphproxy"
+		}
+		nodeID = hostname
+	}
+	rotationHistoryMaxLen = *historyMaxLen
 
 	if err := checkCertificates("server.crt", "server.key"); err != nil {
 		log.Fatalf("Certificate check failed: %v", err)
@@ -174,19 +316,56 @@ func main() {
 		}
 	}
 
+	configReloader = NewConfigReloader()
 	if *headerRulesFile != "" {
 		logInfo("Loading header rules from %s", *headerRulesFile)
-		headerRules = loadHeaderRules(*headerRulesFile)
+		rules, err := loadHeaderRules(*headerRulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load header rules: %v", err)
+		}
+		setHeaderRules(rules)
+		configReloader.Add("header rules", *headerRulesFile, len(rules), reloadHeaderRulesFile)
+		logSuccess("Header rules loaded successfully")
+	} else if config != nil && config.HeaderRules.Rules != nil {
+		logInfo("Using %d header rules from %s", len(config.HeaderRules.Rules), *configFile)
+		rules, err := compileHeaderRules(config.HeaderRules.Rules)
+		if err != nil {
+			log.Fatalf("Invalid header rules in %s: %v", *configFile, err)
+		}
+		setHeaderRules(rules)
+		configReloader.Add("header rules", *configFile, len(rules), reloadHeaderRulesInline)
 	} else {
 		logWarning("No header rules specified. Header modification is disabled.")
 	}
 
+	if *handoffRulesFile != "" {
+		logInfo("Loading handoff rules from %s", *handoffRulesFile)
+		config, err := LoadHandoffConfig(*handoffRulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load handoff rules: %v", err)
+		}
+		handoffConfig = config
+	}
+	if isFlagSet("handoff-mode") || *handoffRulesFile == "" {
+		handoffConfig.DefaultMode = *handoffMode
+	}
+	if isFlagSet("handoff-max-hops") || *handoffRulesFile == "" {
+		handoffConfig.MaxHops = *handoffMaxHops
+	}
+	if err := handoffConfig.Validate(); err != nil {
+		log.Fatalf("Invalid handoff configuration: %v", err)
+	}
+	if handoffConfig.UsesForward() {
+		logWarning("Forward handoff enabled: matching requests are served through stale proxy ports instead of being redirected, which weakens the moving target")
+	}
+
 	if *queueSystem {
-		queue := NewQueue("localhost:6379", "proxy_requests", "proxy_group")
+		queue := NewQueue(stateStore, "proxy_requests", "proxy_group")
 		if err := ensureQueueSetup(queue); err != nil {
 			logError("Failed to setup queue: %v", err)
 		}
 		addTestMessage(queue)
+		backgroundTasks.Add(1)
 		go startConsumers(queue)
 	}
 
@@ -196,6 +375,32 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to load ACL file: %v", err)
 		}
+		if *aclPersist != ACLPersistStore {
+			configReloader.Add("ACL rules", *aclFile, len(aclConfig.Rules), reloadACLFile)
+		}
+	} else if config != nil && config.ACL.Rules != nil {
+		logInfo("Using %d ACL rules from %s", len(config.ACL.Rules), *configFile)
+		aclConfig = &ACLConfig{}
+		if err := aclConfig.SetRules(config.ACL.Rules); err != nil {
+			log.Fatalf("Invalid ACL rules in %s: %v", *configFile, err)
+		}
+		if *aclPersist != ACLPersistStore {
+			configReloader.Add("ACL rules", *configFile, len(aclConfig.Rules), reloadACLInline)
+		}
+	}
+	if aclConfig != nil {
+		mode, source := *aclPersist, "file:"+*aclFile
+		if *aclFile == "" {
+			source = "config:" + *configFile
+			if mode == ACLPersistFile {
+				logWarning("ACL rules are not read from -acl-file, changes made through the API will not be persisted")
+				mode = ACLPersistNone
+			}
+		}
+		startACLSync(mode, *aclFile, source, *aclHistory)
+	}
+	if *configWatchInterval > 0 {
+		go configReloader.Watch(*configWatchInterval)
 	}
 	if *BackendURLFlag != "" {
 		backendURLserver = *BackendURLFlag
@@ -243,7 +448,74 @@ func main() {
 		proxyURLs = append(proxyURLs, "https://"+serverIP+config.address)
 	}
 
-	proxyManager := NewProxyManager(proxyURLs, *domain)
+	weights, err := parseRotationWeights(*rotationWeights)
+	if err != nil {
+		log.Fatalf("Invalid rotation weights: %v", err)
+	}
+	proxyManager := NewProxyManager(proxyURLs, *domain, RotationConfig{
+		Strategy:   *rotationStrategy,
+		Interval:   *rotationInterval,
+		Jitter:     *rotationJitter,
+		Weights:    weights,
+		Grace:      *rotationGrace,
+		GraceCount: *rotationGraceCount,
+	})
+	if inheritedState != nil {
+		proxyManager.restoreUpgradeState(*inheritedState)
+	}
+
+	rotationTriggers = NewRotationTriggers(proxyManager, RotationTriggerConfig{
+		SuspicionThreshold: *triggerSuspicion,
+		OnMalicious:        *triggerMalicious,
+		OnPortScan:         *triggerPortScan,
+		ACLRules:           strings.Split(*triggerACLRules, ","),
+		Cooldown:           *triggerCooldown,
+	})
+
+	// Port hopping opens each new listener on the node that rotates only:
+	// followers and per-session targets would point at ports that no
+	// listener serves.
+	if *portRange != "" && (*leaderElection || *sessionTargeting) {
+		log.Fatalf("Port hopping (-port-range) cannot be combined with -leader-election or -session-targeting")
+	}
+
+	if *leaderElection {
+		if rdb == nil {
+			log.Fatalf("Leader election requires the redis state store")
+		}
+		proxyManager.EnableLeaderElection(rdb, *leaderLease)
+	}
+
+	if *tokenPolicy != "off" {
+		if *leaderElection && *tokenSecret == "" {
+			log.Fatalf("Rotation tokens with leader election require -token-secret, shared by every instance")
+		}
+		// Without -token-secret, a process started by a SIGUSR2 upgrade
+		// keeps the random key of its parent so its tokens stay valid.
+		secret := *tokenSecret
+		if secret == "" && inheritedState != nil {
+			secret = inheritedState.TokenKey
+		}
+		signer, err := NewRotationTokenSigner(RotationTokenConfig{
+			Secret:    secret,
+			TTL:       *tokenTTL,
+			MaxAge:    *tokenMaxAge,
+			MaxLag:    *tokenEpochLag,
+			Policy:    *tokenPolicy,
+			Tarpit:    *tokenTarpit,
+			TarpitMax: *tokenTarpitMax,
+		})
+		if err != nil {
+			log.Fatalf("Invalid rotation token configuration: %v", err)
+		}
+		rotationTokens = signer
+		logInfo("Rotation tokens required on proxy ports (policy: %s)", *tokenPolicy)
+	}
+
+	if *sessionTargeting {
+		logInfo("Per-session moving target enabled")
+		sessionTargets = NewSessionTargeter(proxyManager, stateStore, *sessionRotationInterval, *rotationJitter)
+	}
 
 	mux := http.NewServeMux()
 	if *apiFlag {
@@ -254,24 +526,55 @@ func main() {
 		setupAPIRoutes(mux, proxyManager, apiKey)
 	}
 
+	var suspiciousRating *SuspiciousRating
+	if *enableDetection {
+		logInfo("Attack detection system enabled")
+		suspiciousRating = NewSuspiciousRating(stateStore, *maxSuspicion)
+	} else {
+		logInfo("Attack detection system disabled")
+	}
+
+	if *probePolicy != "off" {
+		detector, err := NewProbeDetector(*probePolicy, *probeSuspicion, *probeBanDuration, *probeDecoyURL, suspiciousRating)
+		if err != nil {
+			log.Fatalf("Invalid probe detection configuration: %v", err)
+		}
+		probeDetector = detector
+		logInfo("Port probe detection enabled (policy: %s)", *probePolicy)
+	}
+
+	var proxyQueue *Queue
 	if *queueSystem {
-		queue := NewQueue("localhost:6379", "proxy_requests", "proxy_group")
-		for _, config := range proxyConfigs {
-			go StartProxyServer(config.id, config.address, config.backendURL, queue, *enableDetection, proxyManager)
+		proxyQueue = NewQueue(stateStore, "proxy_requests", "proxy_group")
+	}
+	activeProxyView.Start(stateStore, *activeProxyReconcile)
+	if redisMonitor != nil {
+		redisMonitor.OnRecover(proxyManager.reconcileAfterOutage)
+	}
+	proxyManager.registry = NewProxyRegistry(serverIP, *drainTimeout, func(proxyID, address, backendURL string) *http.Server {
+		return NewProxyServer(proxyID, address, backendURL, proxyQueue, *enableDetection, proxyManager)
+	})
+	if *portRange != "" {
+		if err := proxyManager.EnablePortHopping(*portRange, backendURLserver); err != nil {
+			log.Fatalf("Failed to enable port hopping: %v", err)
 		}
 	} else {
 		for _, config := range proxyConfigs {
-			go StartProxyServer(config.id, config.address, config.backendURL, nil, *enableDetection, proxyManager)
+			if _, err := proxyManager.registry.Start(config.id, config.address, config.backendURL); err != nil {
+				logError("Failed to start proxy %s: %v", config.id, err)
+			}
 		}
 	}
-
-	var suspiciousRating *SuspiciousRating
-	if *enableDetection {
-		logInfo("Attack detection system enabled")
-		suspiciousRating = NewSuspiciousRating("localhost:6379", 20)
-	} else {
-		logInfo("Attack detection system disabled")
+	if _, ok := proxyManager.strategy.(*healthAwareStrategy); ok && *healthInterval <= 0 {
+		log.Fatalf("The health-aware rotation strategy requires health checks (-health-interval > 0)")
 	}
+	proxyManager.EnableHealthChecks(HealthCheckConfig{
+		Interval: *healthInterval,
+		Timeout:  *healthTimeout,
+		Rise:     *healthRise,
+		Fall:     *healthFall,
+		Fallback: *healthFallback,
+	})
 
 	// Setup Prometheus metrics endpoint
 	mux.Handle("/metrics", promhttp.Handler())
@@ -291,9 +594,15 @@ func main() {
 			return
 		}
 
+		if probeDetector != nil && probeDetector.policy == "ban" && IsIPBanned(remoteIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
 		if *enableDetection && suspiciousRating != nil {
-			ip := r.RemoteAddr
+			ip := remoteIP(r)
 			if suspiciousRating.DetectAttack(r) {
+				rotationTriggers.OnMalicious(ip)
 				suspiciousRating.UpdateRating(ip, 5)
 			}
 			rating := suspiciousRating.GetRating(ip)
@@ -312,11 +621,16 @@ func main() {
 		}
 
 		targetURL := proxy.String() + r.URL.RequestURI()
+		if target, ok := r.Context().Value("sessionTarget").(*SessionTarget); ok {
+			targetURL = target.Proxy + r.URL.RequestURI()
+		}
+		sessionID, _ := r.Context().Value("sessionID").(string)
+		targetURL = withRotationToken(targetURL, sessionID, proxyManager.Epoch(), time.Now())
 		http.Redirect(w, r, targetURL, http.StatusTemporaryRedirect)
 	})))
 
 	server := &http.Server{
-		Addr:         "0.0.0.0:443",
+		Addr:         *listenAddr,
 		Handler:      mux,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
@@ -325,22 +639,50 @@ func main() {
 			MinVersion: tls.VersionTLS12,
 		},
 	}
+	certPath, keyPath := "server.crt", "server.key"
 	if *domain != "" {
 		logInfo("Starting HTTPS server with custom domain %s", *domain)
-		if err := server.ListenAndServeTLS(*certFile, *keyFile); err != nil {
-			log.Fatalf("Failed to start HTTPS server: %v", err)
-		}
+		certPath, keyPath = *certFile, *keyFile
 	} else {
 		logInfo("Starting HTTP to HTTPS redirect server")
 		logInfo("Attempting to start HTTPS server with TLS configuration")
-		if err := server.ListenAndServeTLS("server.crt", "server.key"); err != nil {
+	}
+	entryListener, err := listen(server.Addr)
+	if err != nil {
+		log.Fatalf("Failed to start HTTPS server: %v", err)
+	}
+	closeUnusedListeners()
+	go func() {
+		if err := server.ServeTLS(entryListener, certPath, keyPath); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start HTTPS server: %v", err)
 		}
-	}
+	}()
+
+	sig := waitForSignals(func() {
+		configReloader.ReloadAll()
+	}, func() error {
+		return upgrade(append(proxyManager.registry.Listeners(), entryListener), proxyManager.upgradeState())
+	})
+	logInfo("Received %s", sig)
+	shutdown(server, proxyManager, *drainTimeout)
+}
+
+// isFlagSet reports whether the flag was explicitly set on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
+// startConsumers processes the queue until shutdown. A batch that has been
+// read is always processed and acknowledged before the loop exits.
 func startConsumers(queue *Queue) {
-	for {
+	defer backgroundTasks.Done()
+	for rootCtx.Err() == nil {
 		messages, err := queue.ConsumeFromQueue("consumer1", 10, 5*time.Second)
 		if err != nil {
 			continue
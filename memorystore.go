@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the state in process memory. It is meant for single
+// instances and tests; nothing survives a restart.
+type MemoryStore struct {
+	mu          sync.Mutex
+	values      map[string]*memoryValue
+	streams     map[string]*memoryStream
+	subscribers map[string]map[chan string]bool
+
+	// changed is called after every mutation, with mu held.
+	changed func()
+}
+
+type memoryValue struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type memoryStream struct {
+	Seq     uint64                  `json:"seq"`
+	Base    int                     `json:"base"` // index of Entries[0] since creation
+	Entries []QueueMessage          `json:"entries"`
+	Groups  map[string]*memoryGroup `json:"groups"`
+
+	notify chan struct{} // closed when an entry is added
+}
+
+type memoryGroup struct {
+	Next    int             `json:"next"` // index of the next entry to deliver
+	Pending map[string]bool `json:"pending"`
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values:      make(map[string]*memoryValue),
+		streams:     make(map[string]*memoryStream),
+		subscribers: make(map[string]map[chan string]bool),
+		changed:     func() {},
+	}
+}
+
+// value returns the live value of key. Must be called with ms.mu held.
+func (ms *MemoryStore) value(key string) (*memoryValue, bool) {
+	value, ok := ms.values[key]
+	if ok && !value.Expires.IsZero() && time.Now().After(value.Expires) {
+		delete(ms.values, key)
+		return nil, false
+	}
+	return value, ok
+}
+
+func (ms *MemoryStore) Get(key string) (string, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	value, ok := ms.value(key)
+	if !ok {
+		return "", false, nil
+	}
+	return value.Value, true, nil
+}
+
+func (ms *MemoryStore) Set(key, value string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry := &memoryValue{Value: value}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	ms.values[key] = entry
+	ms.changed()
+	return nil
+}
+
+func (ms *MemoryStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.value(key); ok {
+		return false, nil
+	}
+	entry := &memoryValue{Value: value}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	ms.values[key] = entry
+	ms.changed()
+	return true, nil
+}
+
+func (ms *MemoryStore) Exists(key string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.value(key)
+	return ok, nil
+}
+
+func (ms *MemoryStore) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.values[key]; ok {
+		delete(ms.values, key)
+		ms.changed()
+	}
+	return nil
+}
+
+func (ms *MemoryStore) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.value(key)
+	if !ok {
+		entry = &memoryValue{Value: "0"}
+		if ttl > 0 {
+			entry.Expires = time.Now().Add(ttl)
+		}
+		ms.values[key] = entry
+	}
+	current, err := strconv.ParseInt(entry.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not an integer", key)
+	}
+	current += delta
+	entry.Value = strconv.FormatInt(current, 10)
+	ms.changed()
+	return current, nil
+}
+
+func (ms *MemoryStore) DecayCounters(prefix string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key := range ms.values {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry, ok := ms.value(key)
+		if !ok {
+			continue
+		}
+		if current, err := strconv.ParseInt(entry.Value, 10, 64); err == nil && current > 0 {
+			entry.Value = strconv.FormatInt(current-1, 10)
+		}
+	}
+	ms.changed()
+	return nil
+}
+
+// Publish delivers the message to every subscriber; like Redis, slow
+// subscribers miss messages instead of blocking the publisher.
+func (ms *MemoryStore) Publish(channel, message string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for subscriber := range ms.subscribers[channel] {
+		select {
+		case subscriber <- message:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Subscribe(channel string) (<-chan string, func()) {
+	messages := make(chan string, 16)
+	ms.mu.Lock()
+	if ms.subscribers[channel] == nil {
+		ms.subscribers[channel] = make(map[chan string]bool)
+	}
+	ms.subscribers[channel][messages] = true
+	ms.mu.Unlock()
+
+	return messages, func() {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		if ms.subscribers[channel][messages] {
+			delete(ms.subscribers[channel], messages)
+			close(messages)
+		}
+	}
+}
+
+// stream returns the stream, creating it if needed. Must be called with
+// ms.mu held.
+func (ms *MemoryStore) stream(name string) *memoryStream {
+	stream, ok := ms.streams[name]
+	if !ok {
+		stream = &memoryStream{Groups: make(map[string]*memoryGroup)}
+		ms.streams[name] = stream
+	}
+	if stream.notify == nil {
+		stream.notify = make(chan struct{})
+	}
+	return stream
+}
+
+func (ms *MemoryStore) EnsureQueue(name, group string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stream := ms.stream(name)
+	if _, ok := stream.Groups[group]; !ok {
+		// Like XGROUP CREATE ... $, the group only sees new entries.
+		stream.Groups[group] = &memoryGroup{Next: stream.Base + len(stream.Entries), Pending: make(map[string]bool)}
+		ms.changed()
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Enqueue(name string, values map[string]interface{}) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stream := ms.stream(name)
+	stream.Seq++
+	stream.Entries = append(stream.Entries, QueueMessage{
+		ID:     fmt.Sprintf("%d-%d", time.Now().UnixMilli(), stream.Seq),
+		Values: values,
+	})
+	close(stream.notify)
+	stream.notify = make(chan struct{})
+	ms.changed()
+	return nil
+}
+
+func (ms *MemoryStore) Dequeue(name, group, consumer string, count int64, block time.Duration) ([]QueueMessage, error) {
+	deadline := time.Now().Add(block)
+	for {
+		ms.mu.Lock()
+		stream := ms.stream(name)
+		state, ok := stream.Groups[group]
+		if !ok {
+			ms.mu.Unlock()
+			return nil, fmt.Errorf("NOGROUP no consumer group %s for stream %s", group, name)
+		}
+		var messages []QueueMessage
+		for state.Next < stream.Base+len(stream.Entries) && int64(len(messages)) < count {
+			message := stream.Entries[state.Next-stream.Base]
+			state.Pending[message.ID] = true
+			state.Next++
+			messages = append(messages, message)
+		}
+		notify := stream.notify
+		if len(messages) > 0 {
+			ms.changed()
+		}
+		ms.mu.Unlock()
+
+		wait := time.Until(deadline)
+		if len(messages) > 0 || wait <= 0 {
+			return messages, nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+			return nil, nil
+		case <-rootCtx.Done():
+			timer.Stop()
+			return nil, rootCtx.Err()
+		}
+	}
+}
+
+func (ms *MemoryStore) Ack(name, group, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stream := ms.stream(name)
+	if state, ok := stream.Groups[group]; ok {
+		delete(state.Pending, id)
+	}
+	stream.compact()
+	ms.changed()
+	return nil
+}
+
+// compact drops the entries every group has received and acknowledged.
+func (stream *memoryStream) compact() {
+	if len(stream.Groups) == 0 {
+		return
+	}
+	pending := make(map[string]bool)
+	low := stream.Base + len(stream.Entries)
+	for _, group := range stream.Groups {
+		if group.Next < low {
+			low = group.Next
+		}
+		for id := range group.Pending {
+			pending[id] = true
+		}
+	}
+	drop := 0
+	for drop < low-stream.Base && !pending[stream.Entries[drop].ID] {
+		drop++
+	}
+	stream.Entries = stream.Entries[drop:]
+	stream.Base += drop
+}
+
+func (ms *MemoryStore) QueueLen(name string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stream, ok := ms.streams[name]
+	if !ok {
+		return 0, nil
+	}
+	return int64(len(stream.Entries)), nil
+}
+
+func (ms *MemoryStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for channel, subscribers := range ms.subscribers {
+		for subscriber := range subscribers {
+			close(subscriber)
+		}
+		delete(ms.subscribers, channel)
+	}
+	return nil
+}
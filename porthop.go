@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/rand"
+)
+
+var proxyOpenListeners = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "proxy_open_listeners",
+		Help: "Number of proxy listeners currently open in port hopping mode",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(proxyOpenListeners)
+}
+
+// PortHopper opens a listener on a fresh port at every rotation and shuts
+// retired listeners down once they have drained.
+type PortHopper struct {
+	minPort    int
+	maxPort    int
+	backendURL string
+	registry   *ProxyRegistry
+}
+
+// parsePortRange parses a "min-max" port range.
+func parsePortRange(portRange string) (int, int, error) {
+	parts := strings.SplitN(portRange, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected min-max", portRange)
+	}
+	minPort, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range start %q", parts[0])
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range end %q", parts[1])
+	}
+	if minPort < 1 || maxPort > 65535 || minPort >= maxPort {
+		return 0, 0, fmt.Errorf("invalid port range %d-%d", minPort, maxPort)
+	}
+	return minPort, maxPort, nil
+}
+
+// EnablePortHopping replaces the fixed proxy ports with listeners opened on
+// random ports of portRange. The first listener is opened immediately.
+func (pm *ProxyManager) EnablePortHopping(portRange, backendURL string) error {
+	minPort, maxPort, err := parsePortRange(portRange)
+	if err != nil {
+		return err
+	}
+
+	hopper := &PortHopper{
+		minPort:    minPort,
+		maxPort:    maxPort,
+		backendURL: backendURL,
+		registry:   pm.registry,
+	}
+	first, err := hopper.open()
+	if err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	pm.hopper = hopper
+	pm.proxies = []*url.URL{first}
+	pm.currentProxy = first
+	epoch := pm.epoch
+	pm.mu.Unlock()
+
+	logInfo("Port hopping enabled on ports %d-%d", minPort, maxPort)
+	pm.UpdateActiveProxy(first, epoch)
+	return nil
+}
+
+// hop opens a new listener and retires the current one.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) hop() *url.URL {
+	next, err := pm.hopper.open()
+	if err != nil {
+		logError("Port hopping failed, keeping %s: %v", pm.currentProxy, err)
+		return nil
+	}
+	pm.proxies = []*url.URL{next}
+	pm.hopper.retire(pm.currentProxy, pm.grace)
+	return next
+}
+
+func hopProxyID(port string) string {
+	return "hop" + port
+}
+
+// open starts a proxy server on a random free port of the range.
+func (ph *PortHopper) open() (*url.URL, error) {
+	for attempt := 0; attempt < 50; attempt++ {
+		port := strconv.Itoa(ph.minPort + rand.Intn(ph.maxPort-ph.minPort+1))
+		if _, exists := ph.registry.Get(hopProxyID(port)); exists {
+			continue
+		}
+		instance, err := ph.registry.Start(hopProxyID(port), ":"+port, ph.backendURL)
+		if err != nil {
+			continue
+		}
+		proxyOpenListeners.Inc()
+		return url.Parse(instance.URL)
+	}
+	return nil, fmt.Errorf("no free port found in range %d-%d", ph.minPort, ph.maxPort)
+}
+
+// retire shuts the listener of proxy down after the grace window, waiting
+// up to the drain timeout for in-flight requests.
+func (ph *PortHopper) retire(proxy *url.URL, grace time.Duration) {
+	if proxy == nil {
+		return
+	}
+	time.AfterFunc(grace, func() {
+		if err := ph.registry.Stop(hopProxyID(proxy.Port())); err != nil {
+			logWarning("Failed to close retired listener %s: %v", proxy, err)
+			return
+		}
+		proxyOpenListeners.Dec()
+		logInfo("Closed retired listener %s", proxy)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of requests reaching a non-active proxy port.
+const (
+	ProbeNoSession      = "no_session"      // no valid session cookie
+	ProbeForeignSession = "foreign_session" // session assigned to another proxy
+	ProbeStaleSession   = "stale_session"   // session outside the grace window
+)
+
+// probeDetector is set when requests to non-active proxies are tracked.
+var probeDetector *ProbeDetector
+
+var proxyPortProbesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_port_probes_total",
+		Help: "Total number of requests to non-active proxy ports, by kind and source IP class",
+	},
+	[]string{"kind", "ip_class"},
+)
+
+func init() {
+	prometheus.MustRegister(proxyPortProbesTotal)
+}
+
+// ProbeDetector flags requests to non-active proxy ports as reconnaissance
+// and applies the configured policy: "log", "ban" or "decoy".
+type ProbeDetector struct {
+	policy      string
+	suspicion   int
+	banDuration time.Duration
+	rating      *SuspiciousRating
+	decoy       *httputil.ReverseProxy
+}
+
+func NewProbeDetector(policy string, suspicion int, banDuration time.Duration, decoyURL string, rating *SuspiciousRating) (*ProbeDetector, error) {
+	pd := &ProbeDetector{policy: policy, suspicion: suspicion, banDuration: banDuration, rating: rating}
+	switch policy {
+	case "log", "ban":
+	case "decoy":
+		target, err := url.Parse(decoyURL)
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("decoy policy requires a valid decoy URL, got %q", decoyURL)
+		}
+		pd.decoy = httputil.NewSingleHostReverseProxy(target)
+		EnableSkipSecureVerify(pd.decoy)
+	default:
+		return nil, fmt.Errorf("invalid probe policy %q", policy)
+	}
+	return pd, nil
+}
+
+// classifyProbe returns the kind of a request that reached a non-active
+// proxy outside any grace window.
+func classifyProbe(r *http.Request, target *SessionTarget) string {
+	if _, err := GetSessionID(r); err != nil {
+		return ProbeNoSession
+	}
+	if target != nil {
+		_, port, _ := net.SplitHostPort(r.Host)
+		if previous, err := url.Parse(target.Previous); err != nil || previous.Port() != port {
+			return ProbeForeignSession
+		}
+	}
+	return ProbeStaleSession
+}
+
+// Record accounts for a probe and applies the policy. It returns the
+// response status and true when the request has been answered.
+func (pd *ProbeDetector) Record(w http.ResponseWriter, r *http.Request, proxyID, kind string) (string, bool) {
+	ip := remoteIP(r)
+	proxyPortProbesTotal.WithLabelValues(kind, ipClass(ip)).Inc()
+	logWarning("%s probe from %s on %s: %s %s", kind, ip, proxyID, r.Method, r.URL.Path)
+
+	// Clients with a session that is merely stale, like one following an
+	// old link, are counted but not suspected, and are still handed off.
+	if kind == ProbeStaleSession {
+		return "", false
+	}
+
+	if pd.rating != nil {
+		pd.rating.UpdateRating(ip, pd.suspicion)
+	}
+	rotationTriggers.OnPortScan(ip)
+
+	switch pd.policy {
+	case "ban":
+		BanIP(ip, pd.banDuration)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "403", true
+	case "decoy":
+		logInfo("Diverting %s to decoy", ip)
+		pd.decoy.ServeHTTP(w, r)
+		return "decoy", true
+	}
+	return "", false
+}
+
+// BanIP bans the source IP from every listener for the given duration.
+func BanIP(ip string, duration time.Duration) {
+	key := "banned_ip:" + ip
+	err := errRedisUnavailable
+	if redisUp() {
+		err = stateStore.Set(key, "1", duration)
+	}
+	localFallback.Set(key, 1, duration, err != nil)
+	if err != nil {
+		logError("Failed to ban IP %s in Redis, banned locally: %v", ip, err)
+	}
+	logWarning("IP %s banned for %s", ip, duration)
+}
+
+// IsIPBanned reports whether the source IP is banned.
+func IsIPBanned(ip string) bool {
+	key := "banned_ip:" + ip
+	if redisUp() {
+		banned, err := stateStore.Exists(key)
+		if err == nil {
+			return banned
+		}
+		logError("Error checking ban for IP %s: %v", ip, err)
+	}
+
+	allow, local := degradedDecision(degradedPolicy.Bans)
+	if local {
+		_, banned := localFallback.Get(key)
+		return banned
+	}
+	return !allow
+}
+
+// remoteIP returns the IP of the TCP peer, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipClass groups source IPs for metrics without exploding label cardinality.
+func ipClass(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return "unknown"
+	case parsed.IsLoopback():
+		return "loopback"
+	case parsed.IsPrivate():
+		return "private"
+	case parsed.IsLinkLocalUnicast():
+		return "link_local"
+	case parsed.To4() == nil:
+		return "public_v6"
+	}
+	return "public_v4"
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeDetectorRecord(t *testing.T) {
+	// The ban policy bans through the global state store.
+	previous := stateStore
+	stateStore = NewMemoryStore()
+	t.Cleanup(func() { stateStore = previous })
+
+	cases := []struct {
+		kind      string
+		policy    string
+		suspicion int
+		handled   bool
+	}{
+		{ProbeNoSession, "log", 5, false},
+		{ProbeForeignSession, "log", 5, false},
+		{ProbeStaleSession, "log", 0, false},
+		{ProbeNoSession, "ban", 5, true},
+		{ProbeStaleSession, "ban", 0, false},
+	}
+	for i, c := range cases {
+		t.Run(c.kind+" "+c.policy, func(t *testing.T) {
+			rating := &SuspiciousRating{store: stateStore, maxSuspicion: 100}
+			detector, err := NewProbeDetector(c.policy, 5, time.Minute, "", rating)
+			if err != nil {
+				t.Fatalf("NewProbeDetector: %v", err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:4000", i+1)
+
+			_, handled := detector.Record(httptest.NewRecorder(), r, "proxy-1", c.kind)
+			if handled != c.handled {
+				t.Fatalf("handled = %t, want %t", handled, c.handled)
+			}
+			if got := rating.GetRating(remoteIP(r)); got != c.suspicion {
+				t.Fatalf("suspicion = %d, want %d", got, c.suspicion)
+			}
+			if banned := IsIPBanned(remoteIP(r)); banned != c.handled {
+				t.Fatalf("banned = %t, want %t", banned, c.handled)
+			}
+		})
+	}
+}
@@ -5,42 +5,150 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/go-redis/redis/v8"
-	"golang.org/x/exp/rand"
 )
 
-// startAutoSwitch switches proxies automatically every 10 seconds
+// startAutoSwitch switches proxies automatically on every (jittered) interval
 func (pm *ProxyManager) startAutoSwitch() {
-	for range pm.ticker.C {
-		pm.switchProxy()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-pm.ticker.C:
+			pm.switchProxy("interval")
+			pm.resetTicker()
+		}
 	}
 }
 
-// switchProxy switches to the next proxy in the list
-func (pm *ProxyManager) switchProxy() {
+// switchProxy switches to the proxy chosen by the rotation strategy; reason
+// records what caused the switch
+func (pm *ProxyManager) switchProxy(reason string) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	rand.Shuffle(len(pm.proxies), func(i, j int) {
-		pm.proxies[i], pm.proxies[j] = pm.proxies[j], pm.proxies[i]
-	})
+	// Only the leader rotates. Followers forward event-driven rotations and
+	// leave the scheduled ones to the leader's ticker.
+	if pm.isFollower() {
+		if reason != "interval" {
+			logInfo("Not the rotation leader, forwarding %s rotation", reason)
+			requestRotation(rdb, reason)
+		}
+		return
+	}
 
-	pm.currentProxy = pm.proxies[0]
-	logInfo("Switched to new proxy: %s", pm.currentProxy)
+	// Operators may freeze rotation; only an explicit manual rotation
+	// overrides a pause.
+	if pm.pinned != nil {
+		logInfo("Rotation pinned to %s, ignoring %s rotation", pm.pinned, reason)
+		return
+	}
+	if pm.paused && reason != "manual" {
+		logInfo("Rotation paused, ignoring %s rotation", reason)
+		return
+	}
+
+	var next *url.URL
+	if pm.hopper != nil {
+		next = pm.hop()
+		if next == nil {
+			return
+		}
+	} else {
+		candidates := pm.rotationCandidates()
+		if len(candidates) == 0 {
+			return
+		}
+		next = pm.strategy.Next(candidates, pm.currentProxy)
+		if next == nil {
+			logWarning("Rotation strategy %s returned no proxy; keeping %s", pm.strategy.Name(), pm.currentProxy)
+			return
+		}
+	}
+
+	pm.setCurrentProxy(next, reason)
+}
+
+// setCurrentProxy makes next the active proxy and publishes the change.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) setCurrentProxy(next *url.URL, reason string) {
+	previous := pm.currentProxy
+	if !sameProxy(next, previous) {
+		pm.retireProxy(previous)
+		pm.epoch = pm.nextEpoch()
+	}
+	pm.currentProxy = next
+	logInfo("Switched to new proxy (%s, reason: %s): %s", pm.strategy.Name(), reason, pm.currentProxy)
+
+	proxySwitchReasonsTotal.WithLabelValues(reason).Inc()
 
 	proxySwitchesTotal.WithLabelValues(pm.currentProxy.String()).Inc()
 
-	pm.UpdateActiveProxy(pm.currentProxy)
+	pm.UpdateActiveProxy(pm.currentProxy, pm.epoch)
+	// A strategy may keep the current proxy, e.g. with a single candidate;
+	// that is not a rotation.
+	if !sameProxy(previous, pm.currentProxy) {
+		pm.recordRotation(previous, pm.currentProxy, reason)
+	}
+}
+
+// Epoch returns the rotation epoch, incremented on every proxy change
+func (pm *ProxyManager) Epoch() uint64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.epoch
+}
+
+// nextEpoch allocates the epoch of a new rotation from the state store, so
+// every instance signs and verifies rotation tokens against the same epoch.
+// While the store is unreachable the epoch advances locally; the store is
+// moved past it on the next rotation.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) nextEpoch() uint64 {
+	if !redisUp() {
+		return pm.epoch + 1
+	}
+	epoch, err := stateStore.IncrBy(proxyEpochKey, 1, 0)
+	if err != nil {
+		logError("Failed to allocate rotation epoch, advancing locally: %v", err)
+		return pm.epoch + 1
+	}
+	if uint64(epoch) <= pm.epoch {
+		epoch = int64(pm.epoch + 1)
+		if err := stateStore.Set(proxyEpochKey, strconv.FormatInt(epoch, 10), 0); err != nil {
+			logError("Failed to store rotation epoch %d: %v", epoch, err)
+		}
+	}
+	return uint64(epoch)
+}
+
+// formatProxyUpdate encodes the message published on proxy_updates.
+func formatProxyUpdate(epoch uint64, activeProxy string) string {
+	return strconv.FormatUint(epoch, 10) + "|" + activeProxy
+}
+
+// parseProxyUpdate decodes a proxy_updates message. Messages without epoch
+// (from older instances) have epoch 0.
+func parseProxyUpdate(message string) (uint64, string) {
+	prefix, activeProxy, found := strings.Cut(message, "|")
+	if !found {
+		return 0, message
+	}
+	epoch, err := strconv.ParseUint(prefix, 10, 64)
+	if err != nil {
+		return 0, message
+	}
+	return epoch, activeProxy
 }
 
 // GetProxy returns the current proxy
@@ -52,27 +160,18 @@ func (pm *ProxyManager) GetProxy() *url.URL {
 	return pm.currentProxy
 }
 
-// UpdateActiveProxy updates the active proxy in Redis
-func (pm *ProxyManager) UpdateActiveProxy(currentProxy *url.URL) {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	defer redisClient.Close()
-
-	// Conserver l'URL actuelle
-	activeProxyURL := currentProxy.String()
-
-	// Remplacer l'IP par le domaine si un domaine est défini
-	if pm.domain != "" {
-		parsedURL, err := url.Parse(activeProxyURL)
-		if err == nil {
-			parsedURL.Host = pm.domain + ":" + strings.Split(parsedURL.Host, ":")[1] // Conserve le port
-			activeProxyURL = parsedURL.String()
-		}
+// UpdateActiveProxy updates the active proxy in Redis and publishes it with
+// its rotation epoch
+func (pm *ProxyManager) UpdateActiveProxy(currentProxy *url.URL, epoch uint64) {
+	activeProxyURL := pm.publicURL(currentProxy)
+	activeProxyView.Store(activeProxyURL)
+	if !redisUp() {
+		logWarning("Redis unreachable, active proxy %s only updated locally", activeProxyURL)
+		return
 	}
 
 	// Mettre à jour Redis
-	err := redisClient.Set(ctx, "active_proxy", activeProxyURL, 0).Err()
+	err := stateStore.Set(activeProxyKey, activeProxyURL, 0)
 	if err != nil {
 		logError("Failed to update active proxy in Redis: %v", err)
 	} else {
@@ -80,23 +179,41 @@ func (pm *ProxyManager) UpdateActiveProxy(currentProxy *url.URL) {
 	}
 
 	// Publier la mise à jour
-	err = redisClient.Publish(ctx, "proxy_updates", activeProxyURL).Err()
+	err = stateStore.Publish(proxyUpdatesChannel, formatProxyUpdate(epoch, activeProxyURL))
 	if err != nil {
 		logError("Failed to publish proxy update: %v", err)
 	}
 }
 
+// publicURL returns the URL clients should use to reach the proxy, with the
+// IP replaced by the domain when one is defined.
+func (pm *ProxyManager) publicURL(proxy *url.URL) string {
+	if pm.domain == "" {
+		return proxy.String()
+	}
+	public := *proxy
+	public.Host = pm.domain + ":" + proxy.Port() // Conserve le port
+	return public.String()
+}
+
 // GetActiveProxy retrieves the currently active proxy from Redis
 func (pm *ProxyManager) GetActiveProxy() (*url.URL, error) {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	defer redisClient.Close()
-
-	activeProxyStr, err := redisClient.Get(ctx, "active_proxy").Result()
+	var activeProxyStr string
+	found := false
+	err := errRedisUnavailable
+	if redisUp() {
+		activeProxyStr, found, err = stateStore.Get(activeProxyKey)
+		if err == nil && !found {
+			err = fmt.Errorf("no active proxy stored")
+		}
+	}
 	if err != nil {
-		logError("Error fetching active proxy from Redis: %v", err)
-		return nil, err
+		// Keep serving from the last known state while Redis is down.
+		var known bool
+		if activeProxyStr, known = activeProxyView.Load(); !known {
+			logError("Error fetching active proxy from Redis: %v", err)
+			return nil, err
+		}
 	}
 
 	parsedURL, err := url.Parse(activeProxyStr)
@@ -113,20 +230,22 @@ func (pm *ProxyManager) GetActiveProxy() (*url.URL, error) {
 }
 
 func getNewProxyURL() string {
-	return currentProxyURL
+	proxy, _ := activeProxyView.Load()
+	return proxy
 }
 
-// StartProxyServer starts a proxy server on the given address and forwards requests to the backendURL.
-func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableDetection bool, pm *ProxyManager) {
+// maxRequestsPerClient caps the requests a client address may send to one
+// proxy server.
+var maxRequestsPerClient = 500
+
+// NewProxyServer builds the proxy server for the given address and backendURL
+// without starting it; the ProxyRegistry owns its lifecycle.
+func NewProxyServer(proxyID, address, backendURL string, queue *Queue, enableDetection bool, pm *ProxyManager) *http.Server {
 	parsedURL, err := url.Parse(backendURL)
 	if err != nil {
 		log.Fatalf("Failed to parse backend URL: %v", err)
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-
 	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
 	EnableSkipSecureVerify(proxy)
 	originalDirector := proxy.Director
@@ -137,19 +256,13 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 			originalDirector(req)
 			req.Header.Add("X-Proxy-ID", proxyID)
 
-			messages, err := queue.client.XReadGroup(ctx, &redis.XReadGroupArgs{
-				Group:    "proxy_group",
-				Consumer: "proxy_consumer",
-				Streams:  []string{"proxy_requests", ">"},
-				Count:    1,
-				Block:    10 * time.Millisecond,
-			}).Result()
+			messages, err := queue.ConsumeFromQueue("proxy_consumer", 1, 10*time.Millisecond)
 
 			if err != nil {
 				return
 			}
 
-			for _, msg := range messages[0].Messages {
+			for _, msg := range messages {
 				if msg.Values["block"] == "true" {
 					req.URL.Host = ""
 					logInfo("Blocked request based on queue message")
@@ -208,13 +321,6 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 		w.Write([]byte("Proxy is healthy"))
 	})
 
-	activeProxy, err := redisClient.Get(ctx, "active_proxy").Result()
-	if err != nil {
-		logError("Failed to get active proxy: %v", err)
-		activeProxy = "https://localhost"
-	}
-	currentProxyURL = activeProxy
-
 	mux.Handle("/", SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		start := time.Now()
@@ -226,13 +332,13 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 			proxyRequestDuration.WithLabelValues(proxyID, r.Method).Observe(duration)
 		}()
 		logRequest(r)
-		mu.Lock()
-		defer mu.Unlock()
-
 		ip := r.RemoteAddr
+		mu.Lock()
 		requestCounts[ip]++
+		count := requestCounts[ip]
+		mu.Unlock()
 
-		if requestCounts[ip] > 500 {
+		if count > maxRequestsPerClient {
 			status = "429"
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
@@ -240,25 +346,75 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 
 		logInfo("%s received : %s", proxyID, r.URL.String())
 
-		activeProxy, err := redisClient.Get(ctx, "active_proxy").Result()
-		if err != nil {
-			logError("Failed to get active proxy: %v", err)
-			status = "500"
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		if probeDetector != nil && probeDetector.policy == "ban" && IsIPBanned(remoteIP(r)) {
+			status = "403"
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
+		// In per-session mode the session's own proxy plays the role of the
+		// active proxy.
+		sessionTarget, _ := r.Context().Value("sessionTarget").(*SessionTarget)
+		var activeProxy string
+		if sessionTarget != nil {
+			activeProxy = sessionTarget.Proxy
+		} else {
+			var known bool
+			activeProxy, known = activeProxyView.Load()
+			if !known {
+				logError("Failed to get active proxy: no active proxy known yet")
+				status = "500"
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Existing sessions may finish on a retired proxy during its grace
+		// window; anything else reaching a non-active proxy is a probe.
+		onActive := "https://"+r.Host == activeProxy
+		inGrace := false
+		if !onActive {
+			_, err := GetSessionID(r)
+			inGrace = err == nil && pm.inGraceWindow(r.Host, sessionTarget)
+			if !inGrace && probeDetector != nil {
+				if probeStatus, handled := probeDetector.Record(w, r, proxyID, classifyProbe(r, sessionTarget)); handled {
+					status = probeStatus
+					return
+				}
+			}
+		}
+
+		sessionID, _ := r.Context().Value("sessionID").(string)
+		epoch := pm.Epoch()
+		// Handoffs carry the issue time of the token presented, so hopping
+		// between proxies does not extend it past the max age. Requests
+		// forwarded by a stale proxy had their token verified there.
+		tokenIssuedAt := time.Now()
+		if rotationTokens != nil && r.Context().Value("handoffForwarded") == nil {
+			rawToken, fromQuery := extractRotationToken(r)
+			token, reason := rotationTokens.Verify(rawToken, sessionID, epoch)
+			if reason != "" {
+				status = "403"
+				rotationTokens.Reject(w, r, proxyID, reason)
+				return
+			}
+			rotationTokens.Refresh(w, token, fromQuery, epoch)
+			tokenIssuedAt = token.IssuedAt
+		}
+
 		if pm.domain != "" && !strings.HasPrefix(activeProxy, "https://"+pm.domain) {
-			status = "302"
-			http.Redirect(w, r, "https://"+pm.domain+r.RequestURI, http.StatusFound)
+			status = handoff(w, r, proxyID, withRotationToken("https://"+pm.domain+r.RequestURI, sessionID, epoch, tokenIssuedAt), pm)
 			return
-		} else {
-			if "https://"+r.Host != activeProxy {
-				status = "302"
-				http.Redirect(w, r, activeProxy+r.RequestURI, http.StatusFound)
+		} else if !onActive {
+			if inGrace {
+				proxyGraceRequestsTotal.WithLabelValues(proxyID).Inc()
+				logInfo("%s serving session in grace window (active proxy: %s)", proxyID, activeProxy)
+			} else {
+				status = handoff(w, r, proxyID, withRotationToken(activeProxy+r.RequestURI, sessionID, epoch, tokenIssuedAt), pm)
 				return
 			}
 		}
+		clearHandoffHops(w, r)
 
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -283,6 +439,7 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 
 			// Vérifier si la réponse contient "MALICIOUS" ou "SAFE"
 			if strings.Contains(detectionResponse, "MALICIOUS") {
+				rotationTriggers.OnMalicious(remoteIP(r))
 				status = "403"
 				htmlContent, err := os.ReadFile("403.html")
 				if err != nil {
@@ -304,7 +461,6 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 
 		}
 		if aclConfig != nil {
-			logInfo("list rule : %v", aclConfig.Rules)
 			if handled := HandleRequestWithACL(r, w, aclConfig); handled {
 				return
 			}
@@ -313,46 +469,13 @@ func StartProxyServer(proxyID, address, backendURL string, queue *Queue, enableD
 
 	})))
 
-	go func() {
-		pubsub := redisClient.Subscribe(ctx, "proxy_updates")
-		defer pubsub.Close()
-
-		for msg := range pubsub.Channel() {
-			logInfo("Received new proxy update: %s", msg.Payload)
-			currentProxyURL = msg.Payload
-		}
-	}()
-
-	server := &http.Server{
+	return &http.Server{
 		Addr:    "0.0.0.0" + address,
 		Handler: mux,
 		TLSConfig: &tls.Config{
 			MinVersion: tls.VersionTLS12,
 		},
 	}
-
-	logInfo("Starting HTTPS proxy server %s on %s", proxyID, address)
-	server.ListenAndServeTLS("server.crt", "server.key")
-}
-
-// ReloadProxiesWithACLConfig reloads all proxies with the updated ACL configuration
-func ReloadProxiesWithACLConfig(proxyManager *ProxyManager, aclConfig *ACLConfig) {
-	proxyManager.mu.Lock()
-	defer proxyManager.mu.Unlock()
-
-	for _, proxy := range proxyManager.proxies {
-		logInfo("Reloading ACL config for proxy: %s", proxy.String())
-	}
-	logInfo("All proxies reloaded with updated ACL configuration")
-}
-
-func ApplyACLToProxies(pm *ProxyManager) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	for _, proxy := range pm.proxies {
-		logInfo("Applying ACL rules to proxy: %s", proxy.String())
-	}
 }
 
 func SessionMiddleware(next http.Handler) http.Handler {
@@ -380,6 +503,14 @@ func SessionMiddleware(next http.Handler) http.Handler {
 		}
 
 		ctx := context.WithValue(r.Context(), "sessionID", sessionID)
+		if sessionTargets != nil {
+			target, err := sessionTargets.Get(sessionID)
+			if err != nil {
+				logError("Failed to get proxy assignment, using global active proxy: %v", err)
+			} else {
+				ctx = context.WithValue(ctx, "sessionTarget", target)
+			}
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
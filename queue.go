@@ -1,81 +1,47 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
 type Queue struct {
-	client *redis.Client
+	store  StateStore
 	stream string
 	group  string
 }
 
-func NewQueue(addr, stream, group string) *Queue {
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
-
+func NewQueue(store StateStore, stream, group string) *Queue {
 	return &Queue{
-		client: client,
+		store:  store,
 		stream: stream,
 		group:  group,
 	}
 }
 
 func (q *Queue) AddToQueue(data map[string]interface{}) error {
-	ctx := context.Background()
-	_, err := q.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: q.stream,
-		Values: data,
-	}).Result()
-	return err
+	return q.store.Enqueue(q.stream, data)
 }
 
-func (q *Queue) ConsumeFromQueue(consumer string, count int64, block time.Duration) ([]redis.XMessage, error) {
-	ctx := context.Background()
-	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
-		Group:    q.group,
-		Consumer: consumer,
-		Streams:  []string{q.stream, ">"},
-		Count:    count,
-		Block:    block,
-	}).Result()
-	if err != nil {
-		return nil, err
-	}
-	if len(streams) > 0 {
-		return streams[0].Messages, nil
-	}
-	return nil, nil
+func (q *Queue) ConsumeFromQueue(consumer string, count int64, block time.Duration) ([]QueueMessage, error) {
+	return q.store.Dequeue(q.stream, q.group, consumer, count, block)
 }
 
 func (q *Queue) AckMessage(id string) error {
-	ctx := context.Background()
-	_, err := q.client.XAck(ctx, q.stream, q.group, id).Result()
-	return err
+	return q.store.Ack(q.stream, q.group, id)
 }
 
 func ensureQueueSetup(queue *Queue) error {
-	ctx := context.Background()
-
-	err := queue.client.XGroupCreateMkStream(ctx, "proxy_requests", "proxy_group", "$").Err()
-	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+	if err := queue.store.EnsureQueue(queue.stream, queue.group); err != nil {
 		return fmt.Errorf("failed to create group: %v", err)
 	}
 
-	count, err := queue.client.XLen(ctx, "proxy_requests").Result()
+	count, err := queue.store.QueueLen(queue.stream)
 	if err != nil {
 		return fmt.Errorf("failed to check stream length: %v", err)
 	}
 	if count == 0 {
-		_, err = queue.client.XAdd(ctx, &redis.XAddArgs{
-			Stream: "proxy_requests",
-			Values: map[string]interface{}{"init": "true"},
-		}).Result()
+		err = queue.AddToQueue(map[string]interface{}{"init": "true"})
 		if err != nil {
 			return fmt.Errorf("failed to add initial message to stream: %v", err)
 		}
@@ -85,13 +51,9 @@ func ensureQueueSetup(queue *Queue) error {
 }
 
 func addTestMessage(queue *Queue) {
-	ctx := context.Background()
-	_, err := queue.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: "proxy_requests",
-		Values: map[string]interface{}{
-			"init": "true",
-		},
-	}).Result()
+	err := queue.AddToQueue(map[string]interface{}{
+		"init": "true",
+	})
 	if err != nil {
 		logWarning("Failed to add test message: %v", err)
 	} else {
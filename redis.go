@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	activeProxyKey      = "active_proxy"
+	proxyEpochKey       = "proxy_epoch"
+	proxyUpdatesChannel = "proxy_updates"
+)
+
+// rdb is the Redis client shared by every subsystem, configured from the
+// -redis-* flags at startup. It is nil when the state store is not Redis.
+var rdb redis.UniversalClient
+
+// redisKeyPrefix namespaces every key, stream and channel so several
+// deployments can share one Redis.
+var redisKeyPrefix string
+
+// redisKey returns the namespaced name of a key, stream or channel.
+func redisKey(name string) string {
+	return redisKeyPrefix + name
+}
+
+// RedisConfig is the connection shared by every subsystem.
+type RedisConfig struct {
+	Addrs         []string // one address, several Sentinels or cluster seeds
+	Password      string
+	DB            int
+	TLS           bool
+	TLSInsecure   bool
+	TLSServerName string
+	MasterName    string // Sentinel master name; enables Sentinel mode
+	Cluster       bool
+	KeyPrefix     string
+}
+
+// parseRedisAddrs splits a comma-separated list of addresses.
+func parseRedisAddrs(value string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Validate checks that the configuration describes a single mode.
+func (config RedisConfig) Validate() error {
+	if len(config.Addrs) == 0 {
+		return fmt.Errorf("no Redis address configured")
+	}
+	if config.Cluster && config.MasterName != "" {
+		return fmt.Errorf("Redis Cluster and Sentinel are mutually exclusive")
+	}
+	if config.Cluster && config.DB != 0 {
+		return fmt.Errorf("Redis Cluster only supports database 0")
+	}
+	if !config.Cluster && config.MasterName == "" && len(config.Addrs) > 1 {
+		return fmt.Errorf("several Redis addresses require Sentinel or Cluster mode")
+	}
+	return nil
+}
+
+// NewRedisClient connects to a standalone Redis, a Sentinel-managed master or
+// a Redis Cluster, and applies the key prefix.
+func NewRedisClient(config RedisConfig) (redis.UniversalClient, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	redisKeyPrefix = config.KeyPrefix
+
+	options := &redis.UniversalOptions{
+		Addrs:      config.Addrs,
+		Password:   config.Password,
+		DB:         config.DB,
+		MasterName: config.MasterName,
+	}
+	if config.TLS {
+		options.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			ServerName:         config.TLSServerName,
+			InsecureSkipVerify: config.TLSInsecure,
+		}
+	}
+
+	mode := "standalone"
+	var client redis.UniversalClient
+	switch {
+	case config.Cluster:
+		mode = "cluster"
+		client = redis.NewClusterClient(options.Cluster())
+	case config.MasterName != "":
+		mode = "sentinel"
+		client = redis.NewFailoverClient(options.Failover())
+	default:
+		client = redis.NewClient(options.Simple())
+	}
+	logInfo("Using Redis %s mode (%s, prefix %q, TLS: %t)", mode, strings.Join(config.Addrs, ","), config.KeyPrefix, config.TLS)
+	return client, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// incrByScript increments a counter and sets its ttl only when the increment
+// creates it, in one step so a counter never outlives a crash without a ttl.
+var incrByScript = redis.NewScript(`
+local created = redis.call("EXISTS", KEYS[1]) == 0
+local value = redis.call("INCRBY", KEYS[1], ARGV[1])
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return value`)
+
+// decayCounterScript decrements a counter only while it is positive.
+var decayCounterScript = redis.NewScript(`
+local value = tonumber(redis.call("GET", KEYS[1]))
+if value and value > 0 then
+	return redis.call("DECR", KEYS[1])
+end
+return 0`)
+
+// RedisStore keeps the state in Redis, namespaced with the key prefix.
+type RedisStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (rs *RedisStore) Get(key string) (string, bool, error) {
+	value, err := rs.client.Get(ctx, redisKey(key)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (rs *RedisStore) Set(key, value string, ttl time.Duration) error {
+	return rs.client.Set(ctx, redisKey(key), value, ttl).Err()
+}
+
+func (rs *RedisStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return rs.client.SetNX(ctx, redisKey(key), value, ttl).Result()
+}
+
+func (rs *RedisStore) Exists(key string) (bool, error) {
+	count, err := rs.client.Exists(ctx, redisKey(key)).Result()
+	return count > 0, err
+}
+
+func (rs *RedisStore) Delete(key string) error {
+	return rs.client.Del(ctx, redisKey(key)).Err()
+}
+
+func (rs *RedisStore) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+	return incrByScript.Run(ctx, rs.client, []string{redisKey(key)}, delta, ttl.Milliseconds()).Int64()
+}
+
+// DecayCounters walks the counters with SCAN, which does not block Redis
+// like KEYS. A cluster is walked on every master, since each one only
+// returns its own keys.
+func (rs *RedisStore) DecayCounters(prefix string) error {
+	pattern := redisKey(prefix) + "*"
+	if cluster, ok := rs.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return decayCounters(ctx, master, pattern)
+		})
+	}
+	return decayCounters(ctx, rs.client, pattern)
+}
+
+func decayCounters(ctx context.Context, client redis.Cmdable, pattern string) error {
+	iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		decayCounterScript.Run(ctx, client, []string{iter.Val()})
+	}
+	return iter.Err()
+}
+
+func (rs *RedisStore) Publish(channel, message string) error {
+	return rs.client.Publish(ctx, redisKey(channel), message).Err()
+}
+
+func (rs *RedisStore) Subscribe(channel string) (<-chan string, func()) {
+	pubsub := rs.client.Subscribe(ctx, redisKey(channel))
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		for msg := range pubsub.Channel() {
+			messages <- msg.Payload
+		}
+	}()
+	return messages, func() { pubsub.Close() }
+}
+
+func (rs *RedisStore) EnsureQueue(stream, group string) error {
+	err := rs.client.XGroupCreateMkStream(ctx, redisKey(stream), group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (rs *RedisStore) Enqueue(stream string, values map[string]interface{}) error {
+	return rs.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: redisKey(stream),
+		Values: values,
+	}).Err()
+}
+
+func (rs *RedisStore) Dequeue(stream, group, consumer string, count int64, block time.Duration) ([]QueueMessage, error) {
+	streams, err := rs.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{redisKey(stream), ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	messages := make([]QueueMessage, 0, len(streams[0].Messages))
+	for _, message := range streams[0].Messages {
+		messages = append(messages, QueueMessage{ID: message.ID, Values: message.Values})
+	}
+	return messages, nil
+}
+
+func (rs *RedisStore) Ack(stream, group, id string) error {
+	return rs.client.XAck(ctx, redisKey(stream), group, id).Err()
+}
+
+func (rs *RedisStore) QueueLen(stream string) (int64, error) {
+	return rs.client.XLen(ctx, redisKey(stream)).Result()
+}
+
+// Close closes the shared Redis client.
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Proxy instance states.
+const (
+	ProxyRunning  = "running"
+	ProxyStopping = "stopping"
+	ProxyStopped  = "stopped"
+	ProxyFailed   = "failed"
+)
+
+// ProxyInstance is a proxy listener owned by the registry.
+type ProxyInstance struct {
+	ID         string       `json:"id"`
+	URL        string       `json:"url"`
+	Address    string       `json:"address"`
+	BackendURL string       `json:"backend_url"`
+	State      string       `json:"state"`
+	StartedAt  time.Time    `json:"started_at"`
+	Error      string       `json:"error,omitempty"`
+	Server     *http.Server `json:"-"`
+	listener   net.Listener
+	seq        int
+}
+
+// ProxyRegistry starts, tracks and stops the proxy servers. It has its own
+// lock so it can be used while ProxyManager.mu is held.
+type ProxyRegistry struct {
+	mu        sync.Mutex
+	host      string
+	drain     time.Duration
+	instances map[string]*ProxyInstance
+	seq       int
+	newServer func(proxyID, address, backendURL string) *http.Server
+}
+
+func NewProxyRegistry(host string, drain time.Duration, newServer func(proxyID, address, backendURL string) *http.Server) *ProxyRegistry {
+	return &ProxyRegistry{
+		host:      host,
+		drain:     drain,
+		instances: make(map[string]*ProxyInstance),
+		newServer: newServer,
+	}
+}
+
+// Start binds the address and serves a new proxy on it. Binding happens
+// synchronously so errors are reported to the caller.
+func (reg *ProxyRegistry) Start(id, address, backendURL string) (*ProxyInstance, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if existing, ok := reg.instances[id]; ok && existing.State != ProxyStopped && existing.State != ProxyFailed {
+		return nil, fmt.Errorf("proxy %s already exists", id)
+	}
+	proxyURL, err := url.Parse(fmt.Sprintf("https://%s%s", reg.host, address))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listen("0.0.0.0" + address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+
+	instance := &ProxyInstance{
+		ID:         id,
+		URL:        proxyURL.String(),
+		Address:    address,
+		BackendURL: backendURL,
+		State:      ProxyRunning,
+		StartedAt:  time.Now(),
+		Server:     reg.newServer(id, address, backendURL),
+		listener:   listener,
+		seq:        reg.seq,
+	}
+	reg.seq++
+	reg.instances[id] = instance
+	reg.serve(instance, instance.Server, listener)
+	return instance, nil
+}
+
+func (reg *ProxyRegistry) serve(instance *ProxyInstance, server *http.Server, listener net.Listener) {
+	go func() {
+		logInfo("Starting HTTPS proxy server %s on %s", instance.ID, listener.Addr())
+		err := server.ServeTLS(listener, "server.crt", "server.key")
+		if err != nil && err != http.ErrServerClosed {
+			logError("Proxy server %s stopped: %v", instance.ID, err)
+			reg.mu.Lock()
+			if instance.Server == server {
+				instance.State = ProxyFailed
+				instance.Error = err.Error()
+			}
+			reg.mu.Unlock()
+		}
+	}()
+}
+
+// Handler returns the handler of the running proxy listening on port.
+func (reg *ProxyRegistry) Handler(port string) (http.Handler, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, instance := range reg.instances {
+		if instance.State != ProxyRunning {
+			continue
+		}
+		if _, instancePort, err := net.SplitHostPort(instance.Address); err == nil && instancePort == port {
+			return instance.Server.Handler, true
+		}
+	}
+	return nil, false
+}
+
+// Stop shuts the proxy down gracefully, waiting up to the drain timeout for
+// in-flight requests, and removes it from the registry.
+func (reg *ProxyRegistry) Stop(id string) error {
+	reg.mu.Lock()
+	instance, ok := reg.instances[id]
+	if !ok {
+		reg.mu.Unlock()
+		return fmt.Errorf("proxy %s not found", id)
+	}
+	instance.State = ProxyStopping
+	server := instance.Server
+	reg.mu.Unlock()
+
+	shutdownServer(server, reg.drain, id)
+
+	reg.mu.Lock()
+	instance.State = ProxyStopped
+	delete(reg.instances, id)
+	reg.mu.Unlock()
+	logInfo("Proxy %s stopped", id)
+	return nil
+}
+
+// StopAll stops every proxy concurrently, each with the drain timeout.
+func (reg *ProxyRegistry) StopAll() {
+	reg.mu.Lock()
+	ids := make([]string, 0, len(reg.instances))
+	for id := range reg.instances {
+		ids = append(ids, id)
+	}
+	reg.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			reg.Stop(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// Rebind moves the proxy to a new address. The new listener is bound before
+// the old one is drained, so the proxy is never unreachable.
+func (reg *ProxyRegistry) Rebind(id, address string) (oldURL, newURL string, err error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	instance, ok := reg.instances[id]
+	if !ok {
+		return "", "", fmt.Errorf("proxy %s not found", id)
+	}
+	if instance.Address == address {
+		return instance.URL, instance.URL, nil
+	}
+	proxyURL, err := url.Parse(fmt.Sprintf("https://%s%s", reg.host, address))
+	if err != nil {
+		return "", "", err
+	}
+	listener, err := listen("0.0.0.0" + address)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+
+	oldServer := instance.Server
+	oldURL = instance.URL
+	instance.Server = reg.newServer(id, address, instance.BackendURL)
+	instance.listener = listener
+	instance.Address = address
+	instance.URL = proxyURL.String()
+	instance.State = ProxyRunning
+	instance.StartedAt = time.Now()
+	instance.Error = ""
+	reg.serve(instance, instance.Server, listener)
+
+	go shutdownServer(oldServer, reg.drain, id)
+	logInfo("Proxy %s rebound from %s to %s", id, oldURL, instance.URL)
+	return oldURL, instance.URL, nil
+}
+
+// Listeners returns the sockets of the running proxies, to be passed to a
+// new process on upgrade.
+func (reg *ProxyRegistry) Listeners() []net.Listener {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	listeners := make([]net.Listener, 0, len(reg.instances))
+	for _, instance := range reg.instances {
+		if instance.State == ProxyRunning {
+			listeners = append(listeners, instance.listener)
+		}
+	}
+	return listeners
+}
+
+// Get returns a snapshot of the proxy with the given ID.
+func (reg *ProxyRegistry) Get(id string) (ProxyInstance, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	instance, ok := reg.instances[id]
+	if !ok {
+		return ProxyInstance{}, false
+	}
+	return *instance, true
+}
+
+// List returns a snapshot of every proxy in creation order.
+func (reg *ProxyRegistry) List() []ProxyInstance {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	instances := make([]ProxyInstance, 0, len(reg.instances))
+	for _, instance := range reg.instances {
+		instances = append(instances, *instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].seq < instances[j].seq
+	})
+	return instances
+}
+
+func shutdownServer(server *http.Server, drain time.Duration, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logWarning("Proxy %s did not drain in time: %v", id, err)
+		server.Close()
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configReloader is set when at least one rule set can be reloaded.
+var configReloader *ConfigReloader
+
+var (
+	configReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Total number of rule reloads by target and result",
+		},
+		[]string{"target", "result"},
+	)
+	configLastReloadSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_success",
+			Help: "Whether the last reload of the target succeeded (1) or failed (0)",
+		},
+		[]string{"target"},
+	)
+	configLastReloadTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful reload of the target",
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(configReloadsTotal, configLastReloadSuccess, configLastReloadTimestamp)
+}
+
+// ReloadStatus is the outcome of the last reload of a rule set.
+type ReloadStatus struct {
+	Target      string    `json:"target"`
+	File        string    `json:"file"`
+	Rules       int       `json:"rules"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// reloadTarget is a rule set read from a file. load parses and validates the
+// file and swaps the rules in, returning how many were loaded; it must leave
+// the current rules untouched on error.
+type reloadTarget struct {
+	name    string
+	file    string
+	load    func(file string) (int, error)
+	modTime time.Time
+	size    int64
+	status  ReloadStatus
+}
+
+// ConfigReloader reloads the ACL and header rules when their file changes on
+// disk or on SIGHUP. Reloads are serialised, and an invalid file leaves the
+// rules in place until it is fixed.
+type ConfigReloader struct {
+	mu      sync.Mutex
+	targets []*reloadTarget
+}
+
+func NewConfigReloader() *ConfigReloader {
+	return &ConfigReloader{}
+}
+
+// Add registers a rule set that was just loaded from file.
+func (cr *ConfigReloader) Add(name, file string, rules int, load func(file string) (int, error)) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	target := &reloadTarget{name: name, file: file, load: load}
+	target.modTime, target.size = fileStamp(file)
+	now := time.Now()
+	target.status = ReloadStatus{Target: name, File: file, Rules: rules, Success: true, LastAttempt: now, LastSuccess: now}
+	configLastReloadSuccess.WithLabelValues(name).Set(1)
+	configLastReloadTimestamp.WithLabelValues(name).Set(float64(now.Unix()))
+	cr.targets = append(cr.targets, target)
+}
+
+// Watch polls the files every interval and reloads those that changed.
+// Polling works on every filesystem and survives editors that replace the
+// file instead of writing it in place.
+func (cr *ConfigReloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+			cr.mu.Lock()
+			for _, target := range cr.targets {
+				modTime, size := fileStamp(target.file)
+				if modTime.IsZero() || (modTime.Equal(target.modTime) && size == target.size) {
+					continue
+				}
+				target.modTime, target.size = modTime, size
+				logInfo("%s changed, reloading %s", target.file, target.name)
+				cr.reload(target)
+			}
+			cr.mu.Unlock()
+		}
+	}
+}
+
+// ReloadAll reloads every rule set, whether its file changed or not.
+func (cr *ConfigReloader) ReloadAll() []ReloadStatus {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	statuses := make([]ReloadStatus, 0, len(cr.targets))
+	for _, target := range cr.targets {
+		target.modTime, target.size = fileStamp(target.file)
+		cr.reload(target)
+		statuses = append(statuses, target.status)
+	}
+	return statuses
+}
+
+// reload must be called with cr.mu held.
+func (cr *ConfigReloader) reload(target *reloadTarget) {
+	now := time.Now()
+	target.status.LastAttempt = now
+	rules, err := target.load(target.file)
+	if err != nil {
+		logError("Failed to reload %s from %s, keeping current rules: %v", target.name, target.file, err)
+		target.status.Success = false
+		target.status.Error = err.Error()
+		configReloadsTotal.WithLabelValues(target.name, "error").Inc()
+		configLastReloadSuccess.WithLabelValues(target.name).Set(0)
+		return
+	}
+	logSuccess("Reloaded %d %s from %s", rules, target.name, target.file)
+	target.status.Success = true
+	target.status.Error = ""
+	target.status.Rules = rules
+	target.status.LastSuccess = now
+	configReloadsTotal.WithLabelValues(target.name, "success").Inc()
+	configLastReloadSuccess.WithLabelValues(target.name).Set(1)
+	configLastReloadTimestamp.WithLabelValues(target.name).Set(float64(now.Unix()))
+}
+
+// Status returns the last reload of every rule set.
+func (cr *ConfigReloader) Status() []ReloadStatus {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	statuses := make([]ReloadStatus, 0, len(cr.targets))
+	for _, target := range cr.targets {
+		statuses = append(statuses, target.status)
+	}
+	return statuses
+}
+
+// fileStamp returns the modification time and size of the file, or zero
+// values when it cannot be read (e.g. while it is being replaced).
+func fileStamp(file string) (time.Time, int64) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
+
+// reloadACLFile swaps the rules of aclConfig for those of the file.
+func reloadACLFile(file string) (int, error) {
+	config, err := LoadACLConfig(file)
+	if err != nil {
+		return 0, err
+	}
+	if err := swapACLRules(config.Rules, "file:"+file); err != nil {
+		return 0, err
+	}
+	return len(config.Rules), nil
+}
+
+// reloadACLInline swaps the rules of aclConfig for those defined inline in
+// the configuration file. Other settings of the file are not reapplied.
+func reloadACLInline(file string) (int, error) {
+	config, _, err := LoadConfig(file)
+	if err != nil {
+		return 0, err
+	}
+	if err := swapACLRules(config.ACL.Rules, "config:"+file); err != nil {
+		return 0, err
+	}
+	return len(config.ACL.Rules), nil
+}
+
+// swapACLRules installs reloaded rules and records them in the ACL history.
+// The reload stands even if it cannot be recorded.
+func swapACLRules(rules []ACLRule, source string) error {
+	aclMutex.Lock()
+	defer aclMutex.Unlock()
+	if err := aclConfig.SetRules(rules); err != nil {
+		return err
+	}
+	if aclSync != nil {
+		if err := aclSync.Record(rules, source, "reloaded"); err != nil {
+			logWarning("Reloaded ACL rules not recorded in history: %v", err)
+		}
+	}
+	return nil
+}
+
+// reloadHeaderRulesFile swaps the header rules for those of the file.
+func reloadHeaderRulesFile(file string) (int, error) {
+	rules, err := loadHeaderRules(file)
+	if err != nil {
+		return 0, err
+	}
+	setHeaderRules(rules)
+	return len(rules), nil
+}
+
+// reloadHeaderRulesInline swaps the header rules for those defined inline in
+// the configuration file.
+func reloadHeaderRulesInline(file string) (int, error) {
+	config, _, err := LoadConfig(file)
+	if err != nil {
+		return 0, err
+	}
+	rules, err := compileHeaderRules(config.HeaderRules.Rules)
+	if err != nil {
+		return 0, err
+	}
+	setHeaderRules(rules)
+	return len(rules), nil
+}
+
+// handleReload returns the last reload of each rule set on GET, and reloads
+// them all on POST, answering 422 if any of them was rejected.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	logAPIRequest(r)
+	if configReloader == nil {
+		http.Error(w, "No reloadable rules configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(configReloader.Status())
+	case http.MethodPost:
+		statuses := configReloader.ReloadAll()
+		for _, status := range statuses {
+			if !status.Success {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(statuses)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
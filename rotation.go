@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/rand"
+)
+
+var (
+	proxyGraceOverlapsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_grace_overlaps_total",
+			Help: "Total number of grace windows opened for a retired proxy",
+		},
+		[]string{"proxy_id"},
+	)
+	proxyGraceRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_grace_requests_total",
+			Help: "Total number of requests served by a retired proxy during its grace window",
+		},
+		[]string{"proxy_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(proxyGraceOverlapsTotal, proxyGraceRequestsTotal)
+}
+
+// RotationStrategy selects the next proxy among the candidates.
+// Implementations are called with ProxyManager.mu held.
+type RotationStrategy interface {
+	Name() string
+	Next(candidates []*url.URL, current *url.URL) *url.URL
+}
+
+// NewRotationStrategy builds a strategy from its name. The "health-aware"
+// strategy may wrap another one, e.g. "health-aware:round-robin".
+func NewRotationStrategy(name string, weights map[string]int) (RotationStrategy, error) {
+	switch {
+	case name == "" || name == "random":
+		return &randomStrategy{}, nil
+	case name == "round-robin":
+		return &roundRobinStrategy{}, nil
+	case name == "weighted":
+		return &weightedStrategy{weights: weights}, nil
+	case name == "health-aware":
+		return &healthAwareStrategy{inner: &randomStrategy{}}, nil
+	case strings.HasPrefix(name, "health-aware:"):
+		inner, err := NewRotationStrategy(strings.TrimPrefix(name, "health-aware:"), weights)
+		if err != nil {
+			return nil, err
+		}
+		return &healthAwareStrategy{inner: inner}, nil
+	}
+	return nil, fmt.Errorf("unknown rotation strategy %q", name)
+}
+
+// parseRotationWeights parses a "port=weight" comma-separated list.
+func parseRotationWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	if s == "" {
+		return weights, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid weight %q, expected port=weight", pair)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight for port %s: %q", parts[0], parts[1])
+		}
+		weights[parts[0]] = weight
+	}
+	return weights, nil
+}
+
+// resetTicker schedules the next rotation one (jittered) interval from now.
+func (pm *ProxyManager) resetTicker() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	interval := pm.nextInterval()
+	pm.nextRotation = time.Now().Add(interval)
+	pm.ticker.Reset(interval)
+}
+
+// nextInterval returns the rotation interval with a random jitter applied.
+// Must be called with pm.mu held once the manager is running.
+func (pm *ProxyManager) nextInterval() time.Duration {
+	interval := pm.interval
+	if pm.jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(2*pm.jitter))) - pm.jitter
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// RotationState is the runtime rotation state reported by the API.
+type RotationState struct {
+	Current      string    `json:"current"`
+	Strategy     string    `json:"strategy"`
+	Interval     string    `json:"interval"`
+	Jitter       string    `json:"jitter"`
+	Paused       bool      `json:"paused"`
+	Pinned       string    `json:"pinned,omitempty"`
+	Epoch        uint64    `json:"epoch"`
+	NextRotation time.Time `json:"next_rotation"`
+	Leader       bool      `json:"leader"`
+}
+
+// RotationState returns the current rotation state.
+func (pm *ProxyManager) RotationState() RotationState {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	state := RotationState{
+		Current:      pm.publicURL(pm.currentProxy),
+		Strategy:     pm.strategy.Name(),
+		Interval:     pm.interval.String(),
+		Jitter:       pm.jitter.String(),
+		Paused:       pm.paused,
+		Epoch:        pm.epoch,
+		NextRotation: pm.nextRotation,
+		Leader:       !pm.isFollower(),
+	}
+	if pm.pinned != nil {
+		state.Pinned = pm.publicURL(pm.pinned)
+	}
+	return state
+}
+
+// RotateNow switches proxy immediately, even when rotation is paused. On a
+// follower the rotation is forwarded to the leader.
+func (pm *ProxyManager) RotateNow() error {
+	pm.mu.Lock()
+	pinned := pm.pinned
+	pm.mu.Unlock()
+	if pinned != nil {
+		return fmt.Errorf("rotation is pinned to %s", pinned)
+	}
+	pm.switchProxy("manual")
+	pm.resetTicker()
+	return nil
+}
+
+// Pin makes the given proxy active and stops rotation until Unpin. The
+// target may be a proxy URL or a port. With leader election, the pin is
+// shared and the leader switches to the proxy.
+func (pm *ProxyManager) Pin(target string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, proxy := range pm.proxies {
+		if proxy.String() == target || pm.publicURL(proxy) == target || proxy.Port() == target {
+			pm.pinned = proxy
+			if !pm.isFollower() && !sameProxy(proxy, pm.currentProxy) {
+				pm.setCurrentProxy(proxy, "pin")
+			}
+			logInfo("Rotation pinned to %s", proxy)
+			pm.shareControl()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown proxy %q", target)
+}
+
+// Unpin resumes rotation after Pin.
+func (pm *ProxyManager) Unpin() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.pinned = nil
+	logInfo("Rotation unpinned")
+	pm.shareControl()
+}
+
+// SetPaused pauses or resumes scheduled and event-driven rotation.
+func (pm *ProxyManager) SetPaused(paused bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.paused = paused
+	if paused {
+		logInfo("Rotation paused")
+	} else {
+		logInfo("Rotation resumed")
+	}
+	pm.shareControl()
+}
+
+// SetInterval changes the rotation interval and jitter at runtime.
+func (pm *ProxyManager) SetInterval(interval, jitter time.Duration) error {
+	if interval < time.Second {
+		return fmt.Errorf("interval must be at least 1s")
+	}
+	if jitter < 0 || jitter >= interval {
+		return fmt.Errorf("jitter must be between 0 and the interval")
+	}
+	pm.mu.Lock()
+	pm.interval = interval
+	pm.jitter = jitter
+	pm.shareControl()
+	pm.mu.Unlock()
+
+	pm.resetTicker()
+	logInfo("Rotation interval set to %s (jitter: %s)", interval, jitter)
+	return nil
+}
+
+// retireProxy opens a grace window for the proxy that was just replaced.
+// Must be called with pm.mu held.
+func (pm *ProxyManager) retireProxy(old *url.URL) {
+	if pm.grace <= 0 || pm.graceCount <= 0 || old == nil {
+		return
+	}
+	retired := []retiredProxy{{url: old, retiredAt: time.Now()}}
+	for _, previous := range pm.previous {
+		if !sameProxy(previous.url, old) {
+			retired = append(retired, previous)
+		}
+	}
+	if len(retired) > pm.graceCount {
+		retired = retired[:pm.graceCount]
+	}
+	pm.previous = retired
+	proxyGraceOverlapsTotal.WithLabelValues(old.String()).Inc()
+}
+
+// InGraceWindow reports whether host (host:port) belongs to a recently
+// retired proxy whose grace window is still open. Proxies are matched by port
+// since the public host may be a domain rather than the proxy IP.
+func (pm *ProxyManager) InGraceWindow(host string) bool {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, previous := range pm.previous {
+		if previous.url.Port() == port && time.Since(previous.retiredAt) < pm.grace {
+			return true
+		}
+	}
+	return false
+}
+
+// inGraceWindow checks the grace window of the session's own previous proxy
+// in per-session mode, and the global one otherwise.
+func (pm *ProxyManager) inGraceWindow(host string, target *SessionTarget) bool {
+	if target != nil {
+		return target.InGraceWindow(host, pm.grace)
+	}
+	return pm.InGraceWindow(host)
+}
+
+// randomStrategy picks a random proxy, never the current one twice in a row.
+type randomStrategy struct{}
+
+func (s *randomStrategy) Name() string { return "random" }
+
+func (s *randomStrategy) Next(candidates []*url.URL, current *url.URL) *url.URL {
+	others := excludeProxy(candidates, current)
+	if len(others) == 0 {
+		return current
+	}
+	return others[rand.Intn(len(others))]
+}
+
+// roundRobinStrategy cycles through the proxies in order.
+type roundRobinStrategy struct {
+	next int
+}
+
+func (s *roundRobinStrategy) Name() string { return "round-robin" }
+
+func (s *roundRobinStrategy) Next(candidates []*url.URL, current *url.URL) *url.URL {
+	if len(candidates) == 0 {
+		return current
+	}
+	for i, candidate := range candidates {
+		if sameProxy(candidate, current) {
+			s.next = i + 1
+			break
+		}
+	}
+	proxy := candidates[s.next%len(candidates)]
+	s.next = (s.next + 1) % len(candidates)
+	return proxy
+}
+
+// weightedStrategy picks a random proxy with a probability proportional to the
+// weight of its port. Ports without a weight count as 1.
+type weightedStrategy struct {
+	weights map[string]int
+}
+
+func (s *weightedStrategy) Name() string { return "weighted" }
+
+func (s *weightedStrategy) Next(candidates []*url.URL, current *url.URL) *url.URL {
+	others := excludeProxy(candidates, current)
+	if len(others) == 0 {
+		return current
+	}
+	total := 0
+	for _, proxy := range others {
+		total += s.weight(proxy)
+	}
+	if total == 0 {
+		return others[rand.Intn(len(others))]
+	}
+	pick := rand.Intn(total)
+	for _, proxy := range others {
+		pick -= s.weight(proxy)
+		if pick < 0 {
+			return proxy
+		}
+	}
+	return others[len(others)-1]
+}
+
+func (s *weightedStrategy) weight(proxy *url.URL) int {
+	if weight, ok := s.weights[proxy.Port()]; ok {
+		return weight
+	}
+	return 1
+}
+
+// healthAwareStrategy only hands healthy proxies to the wrapped strategy.
+// When it is selected, rotationCandidates leaves health filtering to it.
+// probe and fallback come from the HealthChecker, set by EnableHealthChecks,
+// so rotating never waits on a probe while pm.mu is held.
+type healthAwareStrategy struct {
+	inner    RotationStrategy
+	probe    func(*url.URL) bool
+	fallback string
+}
+
+func (s *healthAwareStrategy) Name() string { return "health-aware:" + s.inner.Name() }
+
+func (s *healthAwareStrategy) Next(candidates []*url.URL, current *url.URL) *url.URL {
+	if s.probe == nil {
+		return s.inner.Next(candidates, current)
+	}
+	var healthy []*url.URL
+	for _, proxy := range candidates {
+		if s.probe(proxy) {
+			healthy = append(healthy, proxy)
+		}
+	}
+	if len(healthy) == 0 {
+		if s.fallback != "any" {
+			logWarning("No healthy proxy available, keeping current proxy %s", current)
+			return nil
+		}
+		logWarning("No healthy proxy available, rotating among all proxies")
+		healthy = candidates
+	}
+	return s.inner.Next(healthy, current)
+}
+
+func excludeProxy(proxies []*url.URL, excluded *url.URL) []*url.URL {
+	var others []*url.URL
+	for _, proxy := range proxies {
+		if !sameProxy(proxy, excluded) {
+			others = append(others, proxy)
+		}
+	}
+	return others
+}
+
+func sameProxy(a, b *url.URL) bool {
+	return a != nil && b != nil && a.String() == b.String()
+}
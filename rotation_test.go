@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func mustParseURLs(t *testing.T, raw ...string) []*url.URL {
+	t.Helper()
+	urls := make([]*url.URL, len(raw))
+	for i, s := range raw {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("parse %q: %v", s, err)
+		}
+		urls[i] = u
+	}
+	return urls
+}
+
+func TestHealthAwareStrategy(t *testing.T) {
+	proxies := mustParseURLs(t, "https://10.0.0.1:8081", "https://10.0.0.1:8082", "https://10.0.0.1:8083")
+	first, second, third := proxies[0], proxies[1], proxies[2]
+
+	cases := []struct {
+		name      string
+		unhealthy []*url.URL
+		noProbe   bool
+		fallback  string
+		want      []*url.URL // nil means the current proxy is kept
+	}{
+		{name: "all healthy", fallback: "keep", want: []*url.URL{second, third}},
+		{name: "unhealthy skipped", unhealthy: []*url.URL{second}, fallback: "keep", want: []*url.URL{third}},
+		{name: "none healthy keeps current", unhealthy: []*url.URL{first, second, third}, fallback: "keep"},
+		{name: "none healthy rotates among any", unhealthy: []*url.URL{first, second, third}, fallback: "any", want: []*url.URL{second, third}},
+		{name: "without health checks", noProbe: true, want: []*url.URL{second, third}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			strategy := &healthAwareStrategy{inner: &randomStrategy{}, fallback: c.fallback}
+			if !c.noProbe {
+				strategy.probe = func(proxy *url.URL) bool {
+					for _, unhealthy := range c.unhealthy {
+						if sameProxy(proxy, unhealthy) {
+							return false
+						}
+					}
+					return true
+				}
+			}
+			// The inner strategy is random: repeat to cover its choices.
+			for i := 0; i < 20; i++ {
+				next := strategy.Next(proxies, first)
+				if c.want == nil {
+					if next != nil {
+						t.Fatalf("Next = %s, want the current proxy kept", next)
+					}
+					continue
+				}
+				found := false
+				for _, want := range c.want {
+					found = found || sameProxy(next, want)
+				}
+				if !found {
+					t.Fatalf("Next = %v, want one of %v", next, c.want)
+				}
+			}
+		})
+	}
+}
+
+// TestRotationCandidatesHealthFilter checks that the health checker filters
+// the candidates of every strategy but the health-aware one, which filters
+// them itself.
+func TestRotationCandidatesHealthFilter(t *testing.T) {
+	proxies := mustParseURLs(t, "https://10.0.0.1:8081", "https://10.0.0.1:8082", "https://10.0.0.1:8083")
+	health := &HealthChecker{
+		config: HealthCheckConfig{Fallback: "keep"},
+		states: map[string]*ProxyHealth{proxies[1].String(): {Proxy: proxies[1].String()}},
+	}
+
+	cases := []struct {
+		strategy RotationStrategy
+		want     int
+	}{
+		{&randomStrategy{}, 2},
+		{&roundRobinStrategy{}, 2},
+		{&healthAwareStrategy{inner: &randomStrategy{}, probe: health.IsHealthy}, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.strategy.Name(), func(t *testing.T) {
+			pm := &ProxyManager{proxies: proxies, currentProxy: proxies[0], strategy: c.strategy, health: health}
+			candidates := pm.rotationCandidates()
+			if len(candidates) != c.want {
+				t.Fatalf("rotationCandidates = %v, want %d proxies", candidates, c.want)
+			}
+			if next := pm.strategy.Next(candidates, pm.currentProxy); sameProxy(next, proxies[1]) {
+				t.Fatalf("strategy chose the unhealthy proxy %s", next)
+			}
+		})
+	}
+}
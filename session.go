@@ -3,21 +3,18 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/go-redis/redis/v8" // Import the package that defines the rdb variable
 	"github.com/google/uuid"
 )
 
-var rdb = redis.NewClient(&redis.Options{
-	Addr:     "localhost:6379", // Replace with the actual Redis server address
-	Password: "",               // Replace with the actual Redis server password if required
-	DB:       0,                // Replace with the actual Redis database number
-})
-
 var jwtKey = []byte("morphProxySecretKey")
 
+// jwtTTL is the lifetime of session tokens and cookies.
+var jwtTTL = 24 * time.Hour
+
 func GenerateJWT(sessionID, ip string) (string, error) {
 	if !CanGenerateJWT(ip) {
 		return "", fmt.Errorf("rate limit exceeded for IP %s", ip)
@@ -27,7 +24,8 @@ func GenerateJWT(sessionID, ip string) (string, error) {
 		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
 			Id:        sessionID,
-			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(jwtTTL).Unix(),
 		},
 	}
 
@@ -39,47 +37,83 @@ func SetSessionCookie(w http.ResponseWriter, token string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_token",
 		Value:    token,
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  time.Now().Add(jwtTTL),
 		HttpOnly: true,
 		Secure:   true,
 	})
 }
 
 func GetSessionID(r *http.Request) (string, error) {
-	cookie, err := r.Cookie("session_token")
+	claims, err := getSessionClaims(r)
 	if err != nil {
 		return "", err
 	}
+	return claims.SessionID, nil
+}
+
+// getSessionClaims returns the claims of a valid session token.
+func getSessionClaims(r *http.Request) (*Claims, error) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return nil, err
+	}
 
 	tokenStr := cookie.Value
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
 		return jwtKey, nil
 	})
-	if err != nil || !token.Valid {
-		return "", err
+	if err != nil {
+		return nil, err
 	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid session token")
+	}
+	return claims, nil
+}
 
-	return claims.SessionID, nil
+// sessionAge returns how long ago the session token was issued. Tokens
+// issued before iat was set are dated from their expiry.
+func (claims *Claims) sessionAge() time.Duration {
+	issuedAt := claims.IssuedAt
+	if issuedAt == 0 {
+		issuedAt = claims.ExpiresAt - int64(jwtTTL/time.Second)
+	}
+	return time.Since(time.Unix(issuedAt, 0))
 }
 
 func IsSessionBlacklisted(sessionID string) bool {
-	result, err := rdb.Get(ctx, "blacklist:"+sessionID).Result()
-	if err == redis.Nil {
-		logInfo("Session %s is not blacklisted", sessionID)
-		return false
-	} else if err != nil {
+	key := "blacklist:" + sessionID
+	if redisUp() {
+		result, found, err := stateStore.Get(key)
+		if err == nil && !found {
+			logInfo("Session %s is not blacklisted", sessionID)
+			return false
+		} else if err == nil {
+			logInfo("Session %s is blacklisted", sessionID)
+			return result == "1"
+		}
 		logError("Error checking blacklist for session %s: %v", sessionID, err)
-		return false
 	}
-	logInfo("Session %s is blacklisted", sessionID)
-	return result == "1"
+
+	allow, local := degradedDecision(degradedPolicy.Blacklist)
+	if local {
+		_, blacklisted := localFallback.Get(key)
+		return blacklisted
+	}
+	return !allow
 }
 
 func BlacklistSession(sessionID string) {
-	err := rdb.Set(ctx, "blacklist:"+sessionID, "1", 10*time.Minute).Err()
+	key := "blacklist:" + sessionID
+	err := errRedisUnavailable
+	if redisUp() {
+		err = stateStore.Set(key, "1", 10*time.Minute)
+	}
+	// Kept locally as well so the blacklist holds while Redis is down.
+	localFallback.Set(key, 1, 10*time.Minute, err != nil)
 	if err != nil {
-		logError("Failed to blacklist session: %v", err)
+		logError("Failed to blacklist session in Redis, kept locally: %v", err)
 	} else {
 		logInfo("Session %s blacklisted successfully", sessionID)
 	}
@@ -91,24 +125,32 @@ func generateSessionID() string {
 
 func CanGenerateJWT(ip string) bool {
 	key := fmt.Sprintf("jwt_rate:%s", ip)
-	count, err := rdb.Get(ctx, key).Int()
-	if err != nil && err != redis.Nil {
+	if !redisUp() {
+		return canGenerateJWTDegraded(key)
+	}
+	value, _, err := stateStore.Get(key)
+	if err != nil {
 		logError("Failed to check JWT rate limit: %v", err)
-		return false
+		return canGenerateJWTDegraded(key)
 	}
 
-	if count >= 50 {
+	if count, _ := strconv.Atoi(value); count >= 50 {
 		return false
 	}
-	err = rdb.Incr(ctx, key).Err()
+	_, err = stateStore.IncrBy(key, 1, 1*time.Minute)
 	if err != nil {
 		logError("Failed to increment JWT rate limit: %v", err)
 		return false
 	}
 
-	if count == 0 {
-		rdb.Expire(ctx, key, 1*time.Minute)
-	}
-
 	return true
 }
+
+// canGenerateJWTDegraded applies the rate limit policy while Redis is down.
+func canGenerateJWTDegraded(key string) bool {
+	allow, local := degradedDecision(degradedPolicy.RateLimit)
+	if !local {
+		return allow
+	}
+	return localFallback.IncrBy(key, 1, time.Minute) <= 50
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+// sessionTargets is set when every session gets its own proxy and rotation
+// schedule instead of sharing the global active proxy.
+var sessionTargets *SessionTargeter
+
+const (
+	sessionTargetTTL = 24 * time.Hour
+	// sessionRotationLockTTL bounds how long a crashed rotation blocks the
+	// next one.
+	sessionRotationLockTTL = 5 * time.Second
+	// sessionRotationWait is how long a request waits for a rotation run
+	// by a concurrent request before keeping the current assignment.
+	sessionRotationWait = 200 * time.Millisecond
+)
+
+// SessionTargeter assigns a proxy to each session and rotates it on a
+// per-session schedule. Assignments are kept in the state store so every
+// proxy server sees the same view.
+type SessionTargeter struct {
+	pm       *ProxyManager
+	store    StateStore
+	interval time.Duration
+	jitter   time.Duration
+	strategy RotationStrategy
+}
+
+// SessionTarget is the proxy assigned to a session.
+type SessionTarget struct {
+	Proxy        string    `json:"proxy"`
+	Previous     string    `json:"previous,omitempty"`
+	RotatedAt    time.Time `json:"rotated_at"`
+	NextRotation time.Time `json:"next_rotation"`
+}
+
+func NewSessionTargeter(pm *ProxyManager, store StateStore, interval, jitter time.Duration) *SessionTargeter {
+	if interval <= 0 {
+		interval = pm.interval
+	}
+	return &SessionTargeter{
+		pm:       pm,
+		store:    store,
+		interval: interval,
+		jitter:   jitter,
+		strategy: &randomStrategy{},
+	}
+}
+
+func sessionTargetKey(sessionID string) string {
+	return "session_proxy:" + sessionID
+}
+
+func sessionRotationLockKey(sessionID string) string {
+	return "session_proxy_lock:" + sessionID
+}
+
+// expired reports whether the session needs a new proxy.
+func (target *SessionTarget) expired() bool {
+	return target.Proxy == "" || time.Now().After(target.NextRotation)
+}
+
+// Get returns the current assignment of a session, rotating it when its
+// schedule has expired. Only the request holding the session's rotation lock
+// rotates; concurrent requests wait for its result, so a session never
+// bounces between proxies picked by competing requests.
+func (st *SessionTargeter) Get(sessionID string) (*SessionTarget, error) {
+	target, err := st.load(sessionID)
+	if err != nil || !target.expired() {
+		return target, err
+	}
+
+	lock := sessionRotationLockKey(sessionID)
+	acquired, err := st.store.SetNX(lock, nodeID, sessionRotationLockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock proxy assignment of session %s: %v", sessionID, err)
+	}
+	if !acquired {
+		return st.awaitRotation(sessionID, target)
+	}
+	defer st.store.Delete(lock)
+
+	// Another request may have rotated the session between the read and
+	// the lock.
+	if target, err = st.load(sessionID); err != nil || !target.expired() {
+		return target, err
+	}
+	return st.rotate(sessionID, target)
+}
+
+func (st *SessionTargeter) load(sessionID string) (*SessionTarget, error) {
+	data, found, err := st.store.Get(sessionTargetKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	target := &SessionTarget{}
+	if found {
+		if err := json.Unmarshal([]byte(data), target); err != nil {
+			logWarning("Invalid proxy assignment for session %s, reassigning: %v", sessionID, err)
+			target = &SessionTarget{}
+		}
+	}
+	return target, nil
+}
+
+// awaitRotation waits for the rotation run by another request. The expired
+// assignment is kept if it does not complete in time.
+func (st *SessionTargeter) awaitRotation(sessionID string, target *SessionTarget) (*SessionTarget, error) {
+	deadline := time.Now().Add(sessionRotationWait)
+	for time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		rotated, err := st.load(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if !rotated.expired() {
+			return rotated, nil
+		}
+	}
+	if target.Proxy == "" {
+		return nil, fmt.Errorf("proxy assignment of session %s still in progress", sessionID)
+	}
+	return target, nil
+}
+
+// rotate moves a session to a new proxy and schedules its next rotation.
+// Must be called with the session's rotation lock held.
+func (st *SessionTargeter) rotate(sessionID string, target *SessionTarget) (*SessionTarget, error) {
+	st.pm.mu.Lock()
+	candidates := st.pm.rotationCandidates()
+	var current *url.URL
+	for _, candidate := range candidates {
+		if st.pm.publicURL(candidate) == target.Proxy {
+			current = candidate
+		}
+	}
+	next := st.strategy.Next(candidates, current)
+	if next == nil {
+		next = st.pm.currentProxy
+	}
+	proxy := st.pm.publicURL(next)
+	st.pm.mu.Unlock()
+
+	now := time.Now()
+	rotated := &SessionTarget{
+		Proxy:        proxy,
+		Previous:     target.Proxy,
+		RotatedAt:    now,
+		NextRotation: now.Add(st.nextInterval()),
+	}
+
+	data, err := json.Marshal(rotated)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.store.Set(sessionTargetKey(sessionID), string(data), sessionTargetTTL); err != nil {
+		return nil, fmt.Errorf("failed to store proxy assignment for session %s: %v", sessionID, err)
+	}
+
+	logInfo("Session %s assigned to proxy %s until %s", sessionID, rotated.Proxy, rotated.NextRotation.Format(time.RFC3339))
+	return rotated, nil
+}
+
+func (st *SessionTargeter) nextInterval() time.Duration {
+	interval := st.interval
+	if st.jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(2*st.jitter))) - st.jitter
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// InGraceWindow reports whether host is the previous proxy of the session and
+// the rotation grace window is still open.
+func (target *SessionTarget) InGraceWindow(host string, grace time.Duration) bool {
+	if target.Previous == "" || grace <= 0 || time.Since(target.RotatedAt) >= grace {
+		return false
+	}
+	previous, err := url.Parse(target.Previous)
+	if err != nil {
+		return false
+	}
+	_, port, err := net.SplitHostPort(host)
+	return err == nil && previous.Port() == port
+}
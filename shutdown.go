@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rootCtx is cancelled when MorphProxy starts shutting down. Background loops
+// select on it so they stop before the Redis clients are closed.
+var rootCtx, cancelRoot = context.WithCancel(context.Background())
+
+// backgroundTasks tracks the goroutines that must finish their current unit
+// of work (e.g. acknowledging stream messages) before shutdown completes.
+var backgroundTasks sync.WaitGroup
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+)
+
+// onShutdown registers a cleanup function, such as closing a Redis client.
+// Hooks run after the servers have drained, in reverse registration order.
+func onShutdown(hook func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// waitForSignals blocks until SIGINT or SIGTERM is received. SIGHUP calls
+// reload instead of shutting down. SIGUSR2 calls upgrade and, once the new
+// process has taken over the listeners, returns so this one can drain.
+func waitForSignals(reload func(), upgrade func() error) os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			logInfo("Received SIGHUP, reloading configuration")
+			reload()
+			continue
+		}
+		if sig == syscall.SIGUSR2 {
+			logInfo("Received SIGUSR2, handing listeners over to a new process")
+			if err := upgrade(); err != nil {
+				logError("Upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+		}
+		return sig
+	}
+	return nil
+}
+
+// shutdown stops MorphProxy gracefully: background loops are cancelled, the
+// leader lease is released, the entry server and every proxy drain their
+// in-flight requests for up to drain, and the Redis clients are closed last.
+func shutdown(server *http.Server, pm *ProxyManager, drain time.Duration) {
+	logInfo("Shutting down (drain timeout: %s)", drain)
+	cancelRoot()
+
+	pm.mu.Lock()
+	pm.ticker.Stop()
+	election := pm.election
+	pm.mu.Unlock()
+	if election != nil && election.IsLeader() {
+		election.Resign()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shutdownServer(server, drain, "entry")
+	}()
+	if pm.registry != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pm.registry.StopAll()
+		}()
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drain):
+		logWarning("Background tasks did not finish within %s", drain)
+	}
+
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+	logSuccess("Shutdown complete")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// stateStore holds the sessions, blacklists, bans, suspicion ratings, active
+// proxy and request queue.
+var stateStore StateStore
+
+// QueueMessage is one entry of a queue stream.
+type QueueMessage struct {
+	ID     string                 `json:"id"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// StateStore is the state backend shared by the MorphProxy subsystems. The
+// Redis store shares the state between instances; the memory and file stores
+// let a single instance run without Redis.
+type StateStore interface {
+	// Get returns the value of key and whether it exists.
+	Get(key string) (string, bool, error)
+	// Set stores value under key for ttl (0 for no expiry).
+	Set(key, value string, ttl time.Duration) error
+	// SetNX stores value under key for ttl only if key does not exist, and
+	// reports whether it was stored.
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	// Exists reports whether key exists.
+	Exists(key string) (bool, error)
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(key string) error
+	// IncrBy adds delta to the counter under key and returns the new value.
+	// The ttl only applies when the counter is created.
+	IncrBy(key string, delta int64, ttl time.Duration) (int64, error)
+	// DecayCounters decrements every positive counter whose key has prefix.
+	DecayCounters(prefix string) error
+
+	// Publish sends message to the subscribers of channel.
+	Publish(channel, message string) error
+	// Subscribe returns the messages published on channel and a function
+	// that ends the subscription.
+	Subscribe(channel string) (<-chan string, func())
+
+	// EnsureQueue creates the stream and its consumer group if needed.
+	EnsureQueue(stream, group string) error
+	// Enqueue appends a message to stream.
+	Enqueue(stream string, values map[string]interface{}) error
+	// Dequeue delivers up to count new messages to a consumer of group,
+	// waiting up to block for one to arrive.
+	Dequeue(stream, group, consumer string, count int64, block time.Duration) ([]QueueMessage, error)
+	// Ack marks a delivered message as processed.
+	Ack(stream, group, id string) error
+	// QueueLen returns the number of messages in stream.
+	QueueLen(stream string) (int64, error)
+
+	Close() error
+}
+
+// NewStateStore opens the store selected with -state-store. The Redis store
+// requires the shared client to be configured.
+func NewStateStore(kind, path string) (StateStore, error) {
+	switch kind {
+	case "redis":
+		if rdb == nil {
+			return nil, fmt.Errorf("redis store selected but no Redis client configured")
+		}
+		return NewRedisStore(rdb), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return OpenFileStore(path)
+	}
+	return nil, fmt.Errorf("unknown state store %q (redis, memory, file)", kind)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stateStoreBackend opens a fresh store for one test. reopen closes the store
+// and opens it again from its persisted state; it is nil for stores that do
+// not persist.
+type stateStoreBackend struct {
+	name   string
+	open   func(t *testing.T) StateStore
+	reopen func(t *testing.T, store StateStore) StateStore
+}
+
+var stateStoreBackends = []stateStoreBackend{
+	{
+		name: "memory",
+		open: func(t *testing.T) StateStore { return NewMemoryStore() },
+	},
+	{
+		name: "file",
+		open: func(t *testing.T) StateStore {
+			store, err := OpenFileStore(filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatalf("open file store: %v", err)
+			}
+			return store
+		},
+		reopen: func(t *testing.T, store StateStore) StateStore {
+			path := store.(*FileStore).path
+			if err := store.Close(); err != nil {
+				t.Fatalf("close file store: %v", err)
+			}
+			reopened, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("reopen file store: %v", err)
+			}
+			return reopened
+		},
+	},
+}
+
+// TestStateStoreContract runs the same cases against every local backend.
+func TestStateStoreContract(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, backend stateStoreBackend, store StateStore) StateStore
+	}{
+		{"get set delete", testStoreGetSetDelete},
+		{"ttl", testStoreTTL},
+		{"setnx", testStoreSetNX},
+		{"incrby ttl on create only", testStoreIncrByTTL},
+		{"decay counters", testStoreDecayCounters},
+		{"queue", testStoreQueue},
+		{"publish subscribe", testStorePublishSubscribe},
+		{"reopen", testStoreReopen},
+	}
+	for _, backend := range stateStoreBackends {
+		for _, c := range cases {
+			t.Run(backend.name+"/"+c.name, func(t *testing.T) {
+				store := backend.open(t)
+				store = c.run(t, backend, store)
+				store.Close()
+			})
+		}
+	}
+}
+
+func testStoreGetSetDelete(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	if _, found, err := store.Get("missing"); err != nil || found {
+		t.Fatalf("Get(missing) = found %t, %v", found, err)
+	}
+	if err := store.Set("key", "value", 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if value, found, err := store.Get("key"); err != nil || !found || value != "value" {
+		t.Fatalf("Get(key) = %q, %t, %v", value, found, err)
+	}
+	if exists, err := store.Exists("key"); err != nil || !exists {
+		t.Fatalf("Exists(key) = %t, %v", exists, err)
+	}
+	if err := store.Delete("key"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.Delete("key"); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+	if exists, _ := store.Exists("key"); exists {
+		t.Fatal("key still exists after Delete")
+	}
+	return store
+}
+
+func testStoreTTL(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	store.Set("short", "1", 50*time.Millisecond)
+	store.Set("forever", "1", 0)
+	if exists, _ := store.Exists("short"); !exists {
+		t.Fatal("key expired before its ttl")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, found, _ := store.Get("short"); found {
+		t.Fatal("key still readable after its ttl")
+	}
+	if exists, _ := store.Exists("short"); exists {
+		t.Fatal("key still exists after its ttl")
+	}
+	if _, found, _ := store.Get("forever"); !found {
+		t.Fatal("key without ttl expired")
+	}
+	return store
+}
+
+func testStoreSetNX(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	if stored, err := store.SetNX("lock", "a", 50*time.Millisecond); err != nil || !stored {
+		t.Fatalf("SetNX on a missing key = %t, %v", stored, err)
+	}
+	if stored, _ := store.SetNX("lock", "b", time.Hour); stored {
+		t.Fatal("SetNX replaced an existing key")
+	}
+	if value, _, _ := store.Get("lock"); value != "a" {
+		t.Fatalf("lock = %q, want a", value)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if stored, _ := store.SetNX("lock", "c", 0); !stored {
+		t.Fatal("SetNX failed on an expired key")
+	}
+	return store
+}
+
+func testStoreIncrByTTL(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	if value, err := store.IncrBy("counter", 2, 80*time.Millisecond); err != nil || value != 2 {
+		t.Fatalf("IncrBy on create = %d, %v", value, err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	// A later ttl must not extend the window opened on create.
+	if value, err := store.IncrBy("counter", 3, time.Hour); err != nil || value != 5 {
+		t.Fatalf("IncrBy = %d, %v", value, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, found, _ := store.Get("counter"); found {
+		t.Fatal("counter ttl was extended by a later IncrBy")
+	}
+	if value, _ := store.IncrBy("counter", 1, 0); value != 1 {
+		t.Fatalf("IncrBy after expiry = %d, want 1", value)
+	}
+
+	store.Set("text", "abc", 0)
+	if _, err := store.IncrBy("text", 1, 0); err == nil {
+		t.Fatal("IncrBy on a non-integer value succeeded")
+	}
+	return store
+}
+
+func testStoreDecayCounters(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	store.Set("rating:a", "2", 0)
+	store.Set("rating:b", "0", 0)
+	store.Set("other:c", "3", 0)
+	if err := store.DecayCounters("rating:"); err != nil {
+		t.Fatalf("DecayCounters: %v", err)
+	}
+	for key, want := range map[string]string{"rating:a": "1", "rating:b": "0", "other:c": "3"} {
+		if value, _, _ := store.Get(key); value != want {
+			t.Errorf("%s = %q after decay, want %q", key, value, want)
+		}
+	}
+	return store
+}
+
+func testStoreQueue(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	store.Enqueue("queue", map[string]interface{}{"n": "0"}) // before the group: not delivered
+	if err := store.EnsureQueue("queue", "group"); err != nil {
+		t.Fatalf("EnsureQueue: %v", err)
+	}
+	if err := store.EnsureQueue("queue", "group"); err != nil {
+		t.Fatalf("EnsureQueue on an existing group: %v", err)
+	}
+	if _, err := store.Dequeue("queue", "missing", "c1", 1, 0); err == nil {
+		t.Fatal("Dequeue from a missing group succeeded")
+	}
+
+	start := time.Now()
+	if messages, err := store.Dequeue("queue", "group", "c1", 10, 30*time.Millisecond); err != nil || len(messages) != 0 {
+		t.Fatalf("Dequeue on an empty group = %v, %v", messages, err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Fatalf("Dequeue returned after %s instead of blocking", waited)
+	}
+
+	store.Enqueue("queue", map[string]interface{}{"n": "1"})
+	store.Enqueue("queue", map[string]interface{}{"n": "2"})
+	messages, err := store.Dequeue("queue", "group", "c1", 1, 0)
+	if err != nil || len(messages) != 1 || messages[0].Values["n"] != "1" {
+		t.Fatalf("Dequeue = %v, %v", messages, err)
+	}
+	first := messages[0]
+
+	// Delivered messages are pending until acknowledged and are not
+	// delivered again.
+	messages, _ = store.Dequeue("queue", "group", "c2", 10, 0)
+	if len(messages) != 1 || messages[0].Values["n"] != "2" {
+		t.Fatalf("second Dequeue = %v", messages)
+	}
+	if messages, _ := store.Dequeue("queue", "group", "c1", 10, 0); len(messages) != 0 {
+		t.Fatalf("Dequeue redelivered %v", messages)
+	}
+	if length, _ := store.QueueLen("queue"); length < 2 {
+		t.Fatalf("QueueLen = %d with 2 pending messages", length)
+	}
+
+	if err := store.Ack("queue", "group", first.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := store.Ack("queue", "group", messages[0].ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if length, _ := store.QueueLen("queue"); length != 0 {
+		t.Fatalf("QueueLen = %d after acknowledging everything", length)
+	}
+
+	// A blocked consumer wakes up when a message arrives.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.Enqueue("queue", map[string]interface{}{"n": "3"})
+	}()
+	messages, err = store.Dequeue("queue", "group", "c1", 1, time.Second)
+	if err != nil || len(messages) != 1 || messages[0].Values["n"] != "3" {
+		t.Fatalf("blocking Dequeue = %v, %v", messages, err)
+	}
+	return store
+}
+
+func testStorePublishSubscribe(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	messages, unsubscribe := store.Subscribe("channel")
+	store.Publish("other", "ignored")
+	store.Publish("channel", "hello")
+	select {
+	case message := <-messages:
+		if message != "hello" {
+			t.Fatalf("received %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+	unsubscribe()
+	if _, open := <-messages; open {
+		t.Fatal("channel still open after unsubscribe")
+	}
+	return store
+}
+
+func testStoreReopen(t *testing.T, backend stateStoreBackend, store StateStore) StateStore {
+	if backend.reopen == nil {
+		t.Skip("store does not persist")
+	}
+	store.Set("ban", "1", 0)
+	store.Set("expired", "1", 10*time.Millisecond)
+	store.Set("expiring", "1", time.Hour)
+	store.IncrBy("counter", 4, 0)
+	store.EnsureQueue("queue", "group")
+	store.Enqueue("queue", map[string]interface{}{"n": "1"})
+	store.Enqueue("queue", map[string]interface{}{"n": "2"})
+	delivered, _ := store.Dequeue("queue", "group", "c1", 1, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	store = backend.reopen(t, store)
+
+	if value, found, _ := store.Get("ban"); !found || value != "1" {
+		t.Errorf("ban = %q, %t after reopen", value, found)
+	}
+	if _, found, _ := store.Get("expired"); found {
+		t.Error("expired key restored")
+	}
+	if _, found, _ := store.Get("expiring"); !found {
+		t.Error("key with ttl lost")
+	}
+	if value, _ := store.IncrBy("counter", 1, 0); value != 5 {
+		t.Errorf("counter = %d after reopen, want 5", value)
+	}
+	// The delivered message stays pending and the next one is delivered.
+	if length, _ := store.QueueLen("queue"); length != 2 {
+		t.Errorf("QueueLen = %d after reopen, want 2", length)
+	}
+	messages, err := store.Dequeue("queue", "group", "c1", 10, 0)
+	if err != nil || len(messages) != 1 || messages[0].Values["n"] != "2" {
+		t.Fatalf("Dequeue after reopen = %v, %v", messages, err)
+	}
+	if len(delivered) == 1 {
+		store.Ack("queue", "group", delivered[0].ID)
+	}
+	store.Ack("queue", "group", messages[0].ID)
+	if length, _ := store.QueueLen("queue"); length != 0 {
+		t.Errorf("QueueLen = %d after acknowledging everything", length)
+	}
+	return store
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"net/url"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/go-redis/redis/v8"
 )
 
 type ProxyManager struct {
@@ -15,10 +15,41 @@ type ProxyManager struct {
 	ticker       *time.Ticker
 	mu           sync.Mutex
 	domain       string
+	strategy     RotationStrategy
+	interval     time.Duration
+	jitter       time.Duration
+	health       *HealthChecker
+	grace        time.Duration
+	graceCount   int
+	previous     []retiredProxy
+	hopper       *PortHopper
+	epoch        uint64
+	election     *LeaderElection
+	nextRotation time.Time
+	paused       bool
+	pinned       *url.URL
+	registry     *ProxyRegistry
+}
+
+// retiredProxy is a former active proxy that may still serve existing sessions.
+type retiredProxy struct {
+	url       *url.URL
+	retiredAt time.Time
+}
+
+type RotationConfig struct {
+	Strategy string
+	Interval time.Duration
+	Jitter   time.Duration
+	Weights  map[string]int
+	// Grace keeps the GraceCount previous proxies serving requests that
+	// carry a valid session for this long after a rotation.
+	Grace      time.Duration
+	GraceCount int
 }
 
 type SuspiciousRating struct {
-	client       *redis.Client
+	store        StateStore
 	maxSuspicion int
 }
 
@@ -28,22 +59,40 @@ type HeaderRule struct {
 	Value       string
 	Regex       string
 	Replacement string
+
+	re *regexp.Regexp
 }
 type HeaderRulesConfig struct {
 	HeaderRules []HeaderRule `yaml:"header_rules"`
 }
 
+// ACLRule is either a rule, or a named condition (ACL set) that rules can
+// combine in their If expression.
 type ACLRule struct {
-	Name      string      `yaml:"name"`
-	Condition string      `yaml:"condition"`
-	Value     interface{} `yaml:"value"`
-	Action    string      `yaml:"action"`
-	Options   []string    `yaml:"options,omitempty"`
+	Name      string      `yaml:"name,omitempty" json:"name,omitempty"`
+	ACL       string      `yaml:"acl,omitempty" json:"acl,omitempty"`
+	If        string      `yaml:"if,omitempty" json:"if,omitempty"`
+	Condition string      `yaml:"condition,omitempty" json:"condition,omitempty"`
+	Value     interface{} `yaml:"value" json:"value"`
+	Action    string      `yaml:"action,omitempty" json:"action,omitempty"`
+	Options   []string    `yaml:"options,omitempty" json:"options,omitempty"`
 }
 
+// ACLConfig holds the rules and their compiled form. Requests are matched
+// against the rules last passed to SetRules; the other methods edit Rules
+// in place and are meant to prepare a rule set for it.
 type ACLConfig struct {
-	mu    sync.RWMutex
-	Rules []ACLRule `yaml:"rules"`
+	mu       sync.RWMutex
+	Rules    []ACLRule `yaml:"rules"`
+	compiled *compiledACL
+}
+
+// ID returns the name of the rule, or of the named condition.
+func (rule ACLRule) ID() string {
+	if rule.ACL != "" {
+		return rule.ACL
+	}
+	return rule.Name
 }
 
 type Proxy struct {
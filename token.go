@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const rotationTokenParam = "mtd_token"
+
+// rotationTokens is set when proxy ports require a signed rotation token.
+var rotationTokens *RotationTokenSigner
+
+var proxyTokenRejectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_token_rejections_total",
+		Help: "Total number of requests rejected for a missing or invalid rotation token",
+	},
+	[]string{"proxy_id", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(proxyTokenRejectionsTotal)
+}
+
+// RotationTokenSigner issues and verifies short-lived HMAC tokens bound to a
+// session and a rotation epoch. Clients get one from the entry point and
+// carry it to the proxy ports, so scanning the ports is not enough to reach
+// the backend.
+type RotationTokenSigner struct {
+	key    []byte
+	ttl    time.Duration
+	maxAge time.Duration // how long refreshed tokens descend from the first one
+	maxLag uint64        // how many rotations a token stays valid for
+	policy string        // "reject" or "tarpit"
+	tarpit time.Duration // delay before answering in tarpit mode
+	// tarpitted holds a slot per rejected request being delayed; once it is
+	// full, rejections are answered at once.
+	tarpitted chan struct{}
+}
+
+// RotationTokenConfig configures rotation tokens.
+type RotationTokenConfig struct {
+	Secret    string // random if empty
+	TTL       time.Duration
+	MaxAge    time.Duration
+	MaxLag    uint64
+	Policy    string
+	Tarpit    time.Duration
+	TarpitMax int // rejected requests delayed at once
+}
+
+// RotationToken is the verified content of a token. IssuedAt is when the
+// entry point issued the first token of the chain it was refreshed from.
+type RotationToken struct {
+	SessionID string
+	Epoch     uint64
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+}
+
+func NewRotationTokenSigner(config RotationTokenConfig) (*RotationTokenSigner, error) {
+	if config.Policy != "reject" && config.Policy != "tarpit" {
+		return nil, fmt.Errorf("invalid token policy %q", config.Policy)
+	}
+	if config.MaxAge < config.TTL {
+		return nil, fmt.Errorf("token max age %s is shorter than the token ttl %s", config.MaxAge, config.TTL)
+	}
+	if config.Policy == "tarpit" && config.TarpitMax <= 0 {
+		return nil, fmt.Errorf("the tarpit policy requires a positive number of tarpitted requests")
+	}
+	key := []byte(config.Secret)
+	if config.Secret == "" {
+		key = []byte(generateAPIKey())
+	}
+	return &RotationTokenSigner{
+		key:       key,
+		ttl:       config.TTL,
+		maxAge:    config.MaxAge,
+		maxLag:    config.MaxLag,
+		policy:    config.Policy,
+		tarpit:    config.Tarpit,
+		tarpitted: make(chan struct{}, max(config.TarpitMax, 0)),
+	}, nil
+}
+
+// Issue signs a token for the session in the given rotation epoch. issuedAt
+// is now for a new token, or the IssuedAt of the token being refreshed: the
+// token never outlives issuedAt plus the max age.
+func (ts *RotationTokenSigner) Issue(sessionID string, epoch uint64, issuedAt time.Time) string {
+	expiresAt := time.Now().Add(ts.ttl)
+	if limit := issuedAt.Add(ts.maxAge); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+	payload := fmt.Sprintf("%s|%d|%d|%d", sessionID, epoch, expiresAt.Unix(), issuedAt.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(ts.sign(payload))
+}
+
+func (ts *RotationTokenSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, ts.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Verify checks a token for the session against the current epoch. The
+// returned reason is empty when the token is valid.
+func (ts *RotationTokenSigner) Verify(token, sessionID string, currentEpoch uint64) (*RotationToken, string) {
+	if token == "" {
+		return nil, "missing"
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, "malformed"
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "malformed"
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, ts.sign(string(payload))) {
+		return nil, "bad_signature"
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) == 3 {
+		// Issued before the issue time was added, by the parent of a
+		// SIGUSR2 upgrade: it was issued ttl before it expires.
+		fields = append(fields, "")
+	} else if len(fields) != 4 {
+		return nil, "malformed"
+	}
+	epoch, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, "malformed"
+	}
+	expiresAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, "malformed"
+	}
+	issuedAt := expiresAt - int64(ts.ttl.Seconds())
+	if fields[3] != "" {
+		issuedAt, err = strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, "malformed"
+		}
+	}
+
+	parsed := &RotationToken{SessionID: fields[0], Epoch: epoch, ExpiresAt: time.Unix(expiresAt, 0), IssuedAt: time.Unix(issuedAt, 0)}
+	switch {
+	case parsed.SessionID != sessionID:
+		return nil, "session_mismatch"
+	case time.Now().After(parsed.ExpiresAt):
+		return nil, "expired"
+	case epoch+ts.maxLag < currentEpoch:
+		return nil, "stale_epoch"
+	}
+	return parsed, ""
+}
+
+// Reject answers a request that failed token verification. With the
+// tarpit policy the answer is delayed, unless the maximum number of
+// requests is already being delayed or the client goes away.
+func (ts *RotationTokenSigner) Reject(w http.ResponseWriter, r *http.Request, proxyID, reason string) {
+	proxyTokenRejectionsTotal.WithLabelValues(proxyID, reason).Inc()
+	logWarning("%s rejected request from %s (%s %s): rotation token %s", proxyID, r.RemoteAddr, r.Method, r.URL.Path, reason)
+	if ts.policy == "tarpit" {
+		select {
+		case ts.tarpitted <- struct{}{}:
+			timer := time.NewTimer(ts.tarpit)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+			}
+			<-ts.tarpitted
+		default:
+		}
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// extractRotationToken returns the token from the query string, removing it
+// so it never reaches the backend, or from the token cookie.
+func extractRotationToken(r *http.Request) (string, bool) {
+	query := r.URL.Query()
+	if token := query.Get(rotationTokenParam); token != "" {
+		query.Del(rotationTokenParam)
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+		return token, true
+	}
+	if cookie, err := r.Cookie(rotationTokenParam); err == nil {
+		return cookie.Value, false
+	}
+	return "", false
+}
+
+// Refresh stores a fresh token in a cookie when the one presented came from
+// the query string, belongs to an older epoch or is about to expire. Tokens
+// are not refreshed past the max age: the client then has to go back to the
+// entry point for a new one.
+func (ts *RotationTokenSigner) Refresh(w http.ResponseWriter, token *RotationToken, fromQuery bool, currentEpoch uint64) {
+	if !fromQuery && token.Epoch == currentEpoch && time.Until(token.ExpiresAt) > ts.ttl/2 {
+		return
+	}
+	if time.Since(token.IssuedAt) >= ts.maxAge {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     rotationTokenParam,
+		Value:    ts.Issue(token.SessionID, currentEpoch, token.IssuedAt),
+		Path:     "/",
+		MaxAge:   int(ts.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
+
+// withRotationToken adds a token for the session to the target URL. issuedAt
+// is that of the token the client presented, or now at the entry point.
+func withRotationToken(target, sessionID string, epoch uint64, issuedAt time.Time) string {
+	if rotationTokens == nil {
+		return target
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	query := parsed.Query()
+	query.Set(rotationTokenParam, rotationTokens.Issue(sessionID, epoch, issuedAt))
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
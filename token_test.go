@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTokenSigner(t *testing.T, config RotationTokenConfig) *RotationTokenSigner {
+	t.Helper()
+	config.Secret = "secret"
+	if config.Policy == "" {
+		config.Policy = "reject"
+	}
+	signer, err := NewRotationTokenSigner(config)
+	if err != nil {
+		t.Fatalf("NewRotationTokenSigner: %v", err)
+	}
+	return signer
+}
+
+func TestRotationTokenRefreshMaxAge(t *testing.T) {
+	signer := testTokenSigner(t, RotationTokenConfig{TTL: time.Minute, MaxAge: time.Hour, MaxLag: 1})
+
+	cases := []struct {
+		name     string
+		issuedAt time.Time
+		expired  bool
+	}{
+		{"recent", time.Now(), false},
+		{"almost max age", time.Now().Add(-time.Hour + 30*time.Second), false},
+		{"past max age", time.Now().Add(-time.Hour - time.Second), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			token, reason := signer.Verify(signer.Issue("s1", 1, c.issuedAt), "s1", 1)
+			if c.expired {
+				if reason != "expired" {
+					t.Fatalf("Verify = %q, want expired", reason)
+				}
+				return
+			}
+			if reason != "" {
+				t.Fatalf("Verify: %s", reason)
+			}
+
+			w := httptest.NewRecorder()
+			signer.Refresh(w, token, true, 2)
+			cookies := w.Result().Cookies()
+			if len(cookies) == 0 {
+				t.Fatal("token not refreshed")
+			}
+			refreshed, reason := signer.Verify(cookies[0].Value, "s1", 2)
+			if reason != "" {
+				t.Fatalf("Verify refreshed token: %s", reason)
+			}
+			if refreshed.IssuedAt.Unix() != c.issuedAt.Unix() {
+				t.Fatalf("refreshed token issued at %s, want %s", refreshed.IssuedAt, c.issuedAt)
+			}
+			if limit := c.issuedAt.Add(time.Hour); refreshed.ExpiresAt.After(limit) {
+				t.Fatalf("refreshed token expires at %s, after the max age at %s", refreshed.ExpiresAt, limit)
+			}
+		})
+	}
+}
+
+func TestRotationTokenConfigErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		config RotationTokenConfig
+		err    string
+	}{
+		{"unknown policy", RotationTokenConfig{Policy: "drop", TTL: time.Minute, MaxAge: time.Hour}, "invalid token policy"},
+		{"max age below ttl", RotationTokenConfig{Policy: "reject", TTL: time.Hour, MaxAge: time.Minute}, "shorter than the token ttl"},
+		{"tarpit without slots", RotationTokenConfig{Policy: "tarpit", TTL: time.Minute, MaxAge: time.Hour}, "tarpitted requests"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewRotationTokenSigner(c.config)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("NewRotationTokenSigner error = %v, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+// TestRotationTokenTarpitMax checks that rejections beyond the tarpit
+// capacity, or from clients that went away, are answered at once.
+func TestRotationTokenTarpitMax(t *testing.T) {
+	signer := testTokenSigner(t, RotationTokenConfig{Policy: "tarpit", TTL: time.Minute, MaxAge: time.Hour, Tarpit: time.Minute, TarpitMax: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		signer.Reject(httptest.NewRecorder(), r, "proxy-1", "missing")
+	}()
+	for len(signer.tarpitted) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	signer.Reject(w, httptest.NewRequest(http.MethodGet, "/", nil), "proxy-1", "missing")
+	if w.Code != http.StatusForbidden || time.Since(start) > time.Second {
+		t.Fatalf("rejection beyond the tarpit capacity answered %d after %s", w.Code, time.Since(start))
+	}
+
+	cancel()
+	select {
+	case <-held:
+	case <-time.After(time.Second):
+		t.Fatal("tarpitted request not released when its client went away")
+	}
+	if len(signer.tarpitted) != 0 {
+		t.Fatal("tarpit slot not released")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rotationTriggers is set when events may force an immediate rotation.
+var rotationTriggers *RotationTriggers
+
+var proxySwitchReasonsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_switch_reasons_total",
+		Help: "Total number of proxy switches by trigger reason",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(proxySwitchReasonsTotal)
+}
+
+// RotationTriggerConfig selects the events that force an immediate rotation.
+type RotationTriggerConfig struct {
+	SuspicionThreshold int // 0 disables the trigger
+	OnMalicious        bool
+	OnPortScan         bool
+	ACLRules           []string
+	Cooldown           time.Duration
+}
+
+// RotationTriggers forces a proxy switch when a configured event occurs.
+// Each trigger has its own cooldown so attackers cannot cause constant churn.
+type RotationTriggers struct {
+	pm        *ProxyManager
+	config    RotationTriggerConfig
+	aclRules  map[string]bool
+	mu        sync.Mutex
+	lastFired map[string]time.Time
+}
+
+func NewRotationTriggers(pm *ProxyManager, config RotationTriggerConfig) *RotationTriggers {
+	aclRules := make(map[string]bool)
+	for _, name := range config.ACLRules {
+		if name = strings.TrimSpace(name); name != "" {
+			aclRules[name] = true
+		}
+	}
+	return &RotationTriggers{
+		pm:        pm,
+		config:    config,
+		aclRules:  aclRules,
+		lastFired: make(map[string]time.Time),
+	}
+}
+
+// OnSuspicion fires when a suspicion rating crosses the threshold.
+func (rt *RotationTriggers) OnSuspicion(ip string, rating int) {
+	if rt == nil || rt.config.SuspicionThreshold <= 0 || rating < rt.config.SuspicionThreshold {
+		return
+	}
+	rt.fire("suspicion", "suspicion rating of "+ip+" crossed threshold")
+}
+
+// OnMalicious fires when the detection service flags a request.
+func (rt *RotationTriggers) OnMalicious(ip string) {
+	if rt == nil || !rt.config.OnMalicious {
+		return
+	}
+	rt.fire("malicious", "malicious request from "+ip)
+}
+
+// OnPortScan fires when a probe of a non-active proxy is detected.
+func (rt *RotationTriggers) OnPortScan(ip string) {
+	if rt == nil || !rt.config.OnPortScan {
+		return
+	}
+	rt.fire("port_scan", "port scan from "+ip)
+}
+
+// OnACLMatch fires when a named ACL rule matches.
+func (rt *RotationTriggers) OnACLMatch(rule string) {
+	if rt == nil || !rt.aclRules[rule] {
+		return
+	}
+	rt.fire("acl:"+rule, "ACL rule "+rule+" matched")
+}
+
+// AllowForwarded reports whether the leader should execute a rotation
+// forwarded by a follower. Trigger rotations share the cooldown of the
+// leader's own triggers, so followers reacting to the same event rotate once.
+func (rt *RotationTriggers) AllowForwarded(reason string) bool {
+	if rt == nil || !isTriggerReason(reason) {
+		return true
+	}
+	if !rt.cooledDown(reason) {
+		logInfo("Forwarded rotation trigger %s ignored (cooldown)", reason)
+		return false
+	}
+	return true
+}
+
+func isTriggerReason(reason string) bool {
+	switch reason {
+	case "suspicion", "malicious", "port_scan":
+		return true
+	}
+	return strings.HasPrefix(reason, "acl:")
+}
+
+// cooledDown records a firing of trigger unless it fired within the cooldown.
+func (rt *RotationTriggers) cooledDown(trigger string) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if last, ok := rt.lastFired[trigger]; ok && time.Since(last) < rt.config.Cooldown {
+		return false
+	}
+	rt.lastFired[trigger] = time.Now()
+	return true
+}
+
+func (rt *RotationTriggers) fire(trigger, detail string) {
+	if !rt.cooledDown(trigger) {
+		logInfo("Rotation trigger %s ignored (cooldown): %s", trigger, detail)
+		return
+	}
+
+	logWarning("Rotation triggered by %s: %s", trigger, detail)
+	go func() {
+		rt.pm.switchProxy(trigger)
+		rt.pm.resetTicker()
+	}()
+}
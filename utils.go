@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -9,16 +10,13 @@ import (
 	"net/http/httputil"
 	"os"
 	"regexp"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v2"
-
-	"github.com/go-redis/redis/v8"
 )
 
 var (
-	redisClient      *redis.Client
-	currentProxyURL  string
-	headerRules      []HeaderRule
+	headerRules      atomic.Value // []HeaderRule
 	logFile          *os.File
 	requestLogFile   *os.File
 	backendURLserver string
@@ -95,23 +93,60 @@ func init() {
 	}
 }
 
-func loadHeaderRules(filename string) []HeaderRule {
+// loadHeaderRules reads and compiles a header rules file. Nothing is
+// returned unless every rule is valid.
+func loadHeaderRules(filename string) ([]HeaderRule, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		logError("Failed to read header rules file: " + err.Error())
+		return nil, err
 	}
 
 	var config HeaderRulesConfig
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		logError("Failed to parse header rules: " + err.Error())
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
 	}
-	logSuccess("Header rules loaded successfully")
-	return config.HeaderRules
+	return compileHeaderRules(config.HeaderRules)
+}
+
+// compileHeaderRules validates the rules and compiles their regular
+// expressions once, instead of on every response.
+func compileHeaderRules(rules []HeaderRule) ([]HeaderRule, error) {
+	compiled := make([]HeaderRule, len(rules))
+	for i, rule := range rules {
+		if rule.Header == "" {
+			return nil, fmt.Errorf("header rule #%d: missing header", i+1)
+		}
+		switch rule.Action {
+		case "add-header", "set-header", "del-header":
+		case "replace-header":
+			if rule.Regex == "" {
+				return nil, fmt.Errorf("header rule #%d: replace-header requires a regex", i+1)
+			}
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("header rule #%d: invalid regex %q: %v", i+1, rule.Regex, err)
+			}
+			rule.re = re
+		default:
+			return nil, fmt.Errorf("header rule #%d: unknown action %q", i+1, rule.Action)
+		}
+		compiled[i] = rule
+	}
+	return compiled, nil
+}
+
+// setHeaderRules atomically replaces the rules applied to responses.
+func setHeaderRules(rules []HeaderRule) {
+	headerRules.Store(rules)
+}
+
+func currentHeaderRules() []HeaderRule {
+	rules, _ := headerRules.Load().([]HeaderRule)
+	return rules
 }
 
 func applyHeaderRules(resp *http.Response) {
-	for _, rule := range headerRules {
+	for _, rule := range currentHeaderRules() {
 		switch rule.Action {
 		case "add-header":
 			resp.Header.Add(rule.Header, rule.Value)
@@ -120,10 +155,9 @@ func applyHeaderRules(resp *http.Response) {
 		case "del-header":
 			resp.Header.Del(rule.Header)
 		case "replace-header":
-			if rule.Regex != "" {
+			if rule.re != nil {
 				if value := resp.Header.Get(rule.Header); value != "" {
-					re := regexp.MustCompile(rule.Regex)
-					newValue := re.ReplaceAllString(value, rule.Replacement)
+					newValue := rule.re.ReplaceAllString(value, rule.Replacement)
 					resp.Header.Set(rule.Header, newValue)
 				}
 			}